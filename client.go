@@ -23,6 +23,8 @@ import (
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sagernet/quic-go"
 	"github.com/sagernet/sing-quic"
@@ -43,23 +45,94 @@ type ClientOptions struct {
 	UUID              [16]byte
 	Password          string
 	CongestionControl string
+	// MaxConcurrentStreams limits the streams open at the same time for each isolation tag. DialConn and ListenPacket wait for a stream
+	// with the same tag to be closed when the limit is reached, until their context is done. Zero means no limit.
+	MaxConcurrentStreams int
+	// IdleTimeout closes the connection after no streams have been open for IdleTimeout. Zero means no timeout.
+	IdleTimeout time.Duration
+	// MaxLifetime and MaxStreamsPerConnection rotate the connection after its age or the number of its streams reaches the limit.
+	// Open streams drain on the old connection, while new streams go to a new connection. Zero means no limit.
+	MaxLifetime             time.Duration
+	MaxStreamsPerConnection int
+	// HappyEyeballsDelay and Resolver enable racing handshakes to the IPv6 and IPv4 addresses of a domain ServerAddress,
+	// resolved with Resolver. Each attempt starts HappyEyeballsDelay after the previous one, 250ms is recommended by RFC 8305.
+	// The family of the winner is tried first by later connections. If either is not set, the domain is left to Dialer,
+	// so that the server domain is never looked up outside of it.
+	HappyEyeballsDelay time.Duration
+	Resolver           *net.Resolver
+	// EagerConnect starts connecting in NewClient instead of in the first DialConn or ListenPacket.
+	EagerConnect bool
+	// SpareConnection keeps an authenticated spare connection, which replaces the connection when it is closed or rotated.
+	SpareConnection bool
+	// ReconnectBackoff is the delay before connecting again after dialing fails or the server rejects authentication.
+	// It doubles with each consecutive failure up to MaxReconnectBackoff, default 1 minute or ReconnectBackoff if longer,
+	// and is randomized down to half of it.
+	// Meanwhile DialConn and ListenPacket fail with ErrReconnectBackoff. Zero disables the backoff.
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+	Metrics             ClientMetrics
+	Events              ClientEvents
 
 	allowAllCongestionControl bool // do not export
 }
 
 type Client struct {
-	ctx               context.Context
-	dialer            network.Dialer
-	serverAddr        metadata.Socksaddr
-	tlsConfig         tls.Config
-	quicConfig        *quic.Config
-	uuid              [16]byte
-	password          string
-	congestionControl string
+	ctx                 context.Context
+	dialer              network.Dialer
+	serverAddr          metadata.Socksaddr
+	tlsConfig           tls.Config
+	quicConfig          *quic.Config
+	spareQUICConfig     *quic.Config
+	uuid                [16]byte
+	password            string
+	congestionControl   string
+	maxStreamSlots      int
+	idleTimeout         time.Duration
+	maxLifetime         time.Duration
+	maxStreams          int
+	keepSpare           bool
+	happyDelay          time.Duration
+	resolver            *net.Resolver
+	preferIPv4          atomic.Bool
+	reconnectBackoff    time.Duration
+	maxReconnectBackoff time.Duration
+	metrics             ClientMetrics
+	events              ClientEvents
+
+	connAccess    sync.Mutex
+	defaultSlot   clientSlot
+	isolatedSlots map[string]*clientSlot
+
+	stateAccess sync.Mutex
+	connections int
+	failures    int
+	retryAt     time.Time
+	lastErr     error
+}
+
+// clientSlot holds the connection and the stream limit shared by streams with the same isolation tag.
+type clientSlot struct {
+	tag          string
+	conn         *clientQUICConnection
+	pending      *clientOffer
+	spare        *clientQUICConnection
+	pendingSpare *clientOffer
+	streamSlots  chan struct{}
+	// references counts streams opening or open with the slot, which keep it from being collected.
+	references int
+}
 
-	connAccess sync.Mutex
-	conn       *clientQUICConnection
-	pending    *clientOffer
+type isolationTagKey struct{}
+
+// ContextWithIsolationTag makes DialConn and ListenPacket with the returned context use connections of their own,
+// which are not shared with streams with a different tag. The empty tag is the default.
+func ContextWithIsolationTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, isolationTagKey{}, tag)
+}
+
+func IsolationTagFromContext(ctx context.Context) string {
+	tag, _ := ctx.Value(isolationTagKey{}).(string)
+	return tag
 }
 
 func NewClient(options ClientOptions) (*Client, error) {
@@ -73,29 +146,90 @@ func NewClient(options ClientOptions) (*Client, error) {
 	case "cubic", "new_reno", "bbr", "bbr2":
 	default:
 		if !options.allowAllCongestionControl {
-			return nil, exceptions.New("unknown congestion control algorithm: ", options.CongestionControl)
+			return nil, exceptions.Extend(ErrUnknownCongestionControl, options.CongestionControl)
 		}
 	}
-	return &Client{
-		ctx:               options.Context,
-		dialer:            options.Dialer,
-		serverAddr:        options.ServerAddress,
-		tlsConfig:         options.TLSConfig, // clients need to set ALPN `h3` themselves
-		quicConfig:        quicConfig,
-		uuid:              options.UUID,
-		password:          options.Password,
-		congestionControl: options.CongestionControl,
-	}, nil
+	// Spare connections send keep-alives, so that they are not closed by the idle timeout of QUIC while waiting to be used.
+	spareQUICConfig := quicConfig.Clone()
+	spareQUICConfig.KeepAlivePeriod = 15 * time.Second
+	if options.ReconnectBackoff < 0 {
+		return nil, exceptions.New("invalid reconnect backoff: ", options.ReconnectBackoff)
+	}
+	if options.MaxReconnectBackoff == 0 {
+		options.MaxReconnectBackoff = max(time.Minute, options.ReconnectBackoff)
+	} else if options.MaxReconnectBackoff < options.ReconnectBackoff {
+		return nil, exceptions.New("invalid max reconnect backoff: ", options.MaxReconnectBackoff, ", less than reconnect backoff ", options.ReconnectBackoff)
+	}
+	client := &Client{
+		ctx:                 options.Context,
+		dialer:              options.Dialer,
+		serverAddr:          options.ServerAddress,
+		tlsConfig:           options.TLSConfig, // clients need to set ALPN `h3` themselves
+		quicConfig:          quicConfig,
+		spareQUICConfig:     spareQUICConfig,
+		uuid:                options.UUID,
+		password:            options.Password,
+		congestionControl:   options.CongestionControl,
+		maxStreamSlots:      options.MaxConcurrentStreams,
+		idleTimeout:         options.IdleTimeout,
+		maxLifetime:         options.MaxLifetime,
+		maxStreams:          options.MaxStreamsPerConnection,
+		keepSpare:           options.SpareConnection,
+		happyDelay:          options.HappyEyeballsDelay,
+		resolver:            options.Resolver,
+		reconnectBackoff:    options.ReconnectBackoff,
+		maxReconnectBackoff: options.MaxReconnectBackoff,
+		metrics:             options.Metrics,
+		events:              options.Events,
+	}
+	if options.MaxConcurrentStreams > 0 {
+		client.defaultSlot.streamSlots = make(chan struct{}, options.MaxConcurrentStreams)
+	}
+	if options.EagerConnect {
+		go func() {
+			_, _ = client.offer(context.Background())
+		}()
+	}
+	return client, nil
+}
+
+// slotLocked returns the slot of tag. c.connAccess must be held.
+func (c *Client) slotLocked(tag string) *clientSlot {
+	if tag == "" {
+		return &c.defaultSlot
+	}
+	slot := c.isolatedSlots[tag]
+	if slot == nil {
+		if c.isolatedSlots == nil {
+			c.isolatedSlots = make(map[string]*clientSlot)
+		}
+		slot = &clientSlot{tag: tag}
+		if c.maxStreamSlots > 0 {
+			slot.streamSlots = make(chan struct{}, c.maxStreamSlots)
+		}
+		c.isolatedSlots[tag] = slot
+	}
+	return slot
 }
 
 func (c *Client) offer(ctx context.Context) (*clientQUICConnection, error) {
 	c.connAccess.Lock()
-	conn := c.conn
+	slot := c.slotLocked(IsolationTagFromContext(ctx))
+	conn := slot.conn
 	if conn != nil && conn.active() {
 		c.connAccess.Unlock()
 		return conn, nil
 	}
-	pending := c.pending
+	spare := slot.spare
+	slot.spare = nil
+	if spare != nil && spare.active() {
+		slot.conn = spare
+		c.startTimers(spare)
+		c.fillSpareLocked(slot)
+		c.connAccess.Unlock()
+		return spare, nil
+	}
+	pending := slot.pending
 	if pending != nil {
 		c.connAccess.Unlock()
 		select {
@@ -105,6 +239,12 @@ func (c *Client) offer(ctx context.Context) (*clientQUICConnection, error) {
 			return nil, ctx.Err()
 		}
 	}
+	err := c.checkBackoff()
+	if err != nil {
+		c.collectSlotLocked(slot)
+		c.connAccess.Unlock()
+		return nil, err
+	}
 	// A pending offer is shared by concurrent callers. Do not derive offerCtx
 	// from the foreground request ctx: a timed-out request must stop waiting for
 	// the shared result, but it must not tear down the background QUIC dial that
@@ -119,9 +259,9 @@ func (c *Client) offer(ctx context.Context) (*clientQUICConnection, error) {
 		done:   make(chan struct{}),
 		cancel: cancel,
 	}
-	c.pending = pending
+	slot.pending = pending
 	c.connAccess.Unlock()
-	go c.completeOffer(pending, offerCtx)
+	go c.completeOffer(slot, pending, offerCtx)
 	select {
 	case <-pending.done:
 		return pending.conn, pending.err
@@ -130,8 +270,8 @@ func (c *Client) offer(ctx context.Context) (*clientQUICConnection, error) {
 	}
 }
 
-func (c *Client) completeOffer(pending *clientOffer, offerCtx context.Context) {
-	conn, err := c.offerNew(offerCtx)
+func (c *Client) completeOffer(slot *clientSlot, pending *clientOffer, offerCtx context.Context) {
+	conn, err := c.offerNew(offerCtx, c.quicConfig)
 	pending.cancel(nil)
 
 	discardErr := err
@@ -147,37 +287,123 @@ func (c *Client) completeOffer(pending *clientOffer, offerCtx context.Context) {
 		pending.conn = conn
 		pending.err = err
 		if err == nil {
-			c.conn = conn
+			slot.conn = conn
+			c.startTimers(conn)
+			c.fillSpareLocked(slot)
 		}
 	}
-	if c.pending == pending {
-		c.pending = nil
+	if slot.pending == pending {
+		slot.pending = nil
 	}
+	c.collectSlotLocked(slot)
 	close(pending.done)
 	c.connAccess.Unlock()
 
 	if shouldDiscard && conn != nil {
 		conn.closeWithError(discardErr)
 	}
+	if !shouldDiscard && conn != nil && slot.tag != "" {
+		go func() {
+			<-conn.connDone
+			c.connAccess.Lock()
+			c.collectSlotLocked(slot)
+			c.connAccess.Unlock()
+		}()
+	}
 }
 
-func (c *Client) offerNew(ctx context.Context) (*clientQUICConnection, error) {
-	udpConn, err := c.dialer.DialContext(ctx, "udp", c.serverAddr)
-	if err != nil {
-		return nil, err
+// collectSlotLocked removes an isolated slot without a connection in use. c.connAccess must be held.
+func (c *Client) collectSlotLocked(slot *clientSlot) {
+	if slot.tag == "" || c.isolatedSlots[slot.tag] != slot || slot.references > 0 || slot.pending != nil || slot.conn != nil && slot.conn.active() {
+		return
+	}
+	delete(c.isolatedSlots, slot.tag)
+}
+
+// fillSpareLocked starts connecting a spare connection of the default slot, if it is enabled and there is none.
+// Isolated slots have no spare connections. c.connAccess must be held.
+func (c *Client) fillSpareLocked(slot *clientSlot) {
+	if !c.keepSpare || slot.tag != "" || slot.pendingSpare != nil || slot.spare != nil && slot.spare.active() {
+		return
+	}
+	offerCtx := c.ctx
+	if offerCtx == nil {
+		offerCtx = context.Background()
+	}
+	offerCtx, cancel := common.ContextWithCancelCause(offerCtx)
+	pending := &clientOffer{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	slot.pendingSpare = pending
+	go c.completeSpare(slot, pending, offerCtx)
+}
+
+func (c *Client) completeSpare(slot *clientSlot, pending *clientOffer, offerCtx context.Context) {
+	conn, err := c.offerNew(offerCtx, c.spareQUICConfig)
+	pending.cancel(nil)
+	c.connAccess.Lock()
+	discarded := pending.discarded
+	if !discarded && err == nil {
+		slot.spare = conn
+	}
+	if slot.pendingSpare == pending {
+		slot.pendingSpare = nil
 	}
-	var quicConn *quic.Conn
-	quicConn, err = qtls.Dial(ctx, bufio.NewUnbindPacketConn(udpConn), udpConn.RemoteAddr(), c.tlsConfig, c.quicConfig)
+	close(pending.done)
+	c.connAccess.Unlock()
+	if discarded && conn != nil {
+		conn.closeWithError(pending.cause)
+	}
+}
+
+// startTimers starts the idle and lifetime timers of conn when it starts to be offered.
+func (c *Client) startTimers(conn *clientQUICConnection) {
+	conn.streamAccess.Lock()
+	defer conn.streamAccess.Unlock()
+	if c.idleTimeout > 0 && conn.openStreams == 0 {
+		conn.idleTimer = time.AfterFunc(c.idleTimeout, conn.closeIdle)
+	}
+	if c.maxLifetime > 0 {
+		conn.lifetimeTimer = time.AfterFunc(c.maxLifetime, conn.drain)
+	}
+}
+
+func (c *Client) offerNew(ctx context.Context, quicConfig *quic.Config) (*clientQUICConnection, error) {
+	startedAt := time.Now()
+	udpConn, quicConn, err := c.dialServer(ctx, quicConfig)
 	if err != nil {
-		udpConn.Close()
-		return nil, exceptions.Cause(err, "open connection")
+		if c.metrics != nil {
+			c.metrics.DialError()
+		}
+		if !exceptions.IsClosedOrCanceled(err) {
+			c.connectFailed(err)
+		}
+		return nil, err
 	}
 	setCongestion(c.ctx, quicConn, c.congestionControl)
 	conn := &clientQUICConnection{
-		quicConn: quicConn,
-		rawConn:  udpConn,
-		connDone: make(chan struct{}),
+		client:            c,
+		quicConn:          quicConn,
+		rawConn:           udpConn,
+		congestionControl: c.congestionControl,
+		metrics:           c.metrics,
+		connDone:          make(chan struct{}),
+		idleTimeout:       c.idleTimeout,
+		maxStreams:        c.maxStreams,
 	}
+	if c.metrics != nil {
+		c.metrics.HandshakeDuration(time.Since(startedAt))
+		c.metrics.SessionOpened()
+	}
+	c.connectionOpened()
+	go func() {
+		select {
+		case <-quicConn.Context().Done():
+			conn.closeWithError(wrapQUICError(context.Cause(quicConn.Context())))
+		case <-conn.connDone:
+		}
+	}()
 	go func() {
 		hErr := c.clientHandshake(quicConn)
 		if hErr != nil {
@@ -187,6 +413,22 @@ func (c *Client) offerNew(ctx context.Context) (*clientQUICConnection, error) {
 	return conn, nil
 }
 
+// dialQUIC dials through a quic.Transport if possible, so that the connection uses non-empty connection IDs,
+// which are required to migrate it with Rebind. qtls.Dial always uses empty connection IDs.
+func (c *Client) dialQUIC(ctx context.Context, udpConn net.Conn, quicConfig *quic.Config) (*quic.Conn, error) {
+	packetConn := bufio.NewUnbindPacketConn(udpConn)
+	if _, isQUICConfig := c.tlsConfig.(qtls.Config); isQUICConfig {
+		return qtls.Dial(ctx, packetConn, udpConn.RemoteAddr(), c.tlsConfig, quicConfig)
+	}
+	tlsConfig, err := c.tlsConfig.STDConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &quic.Transport{Conn: packetConn}
+	quicConn, err := transport.Dial(ctx, udpConn.RemoteAddr(), tlsConfig, quicConfig)
+	return quicConn, qtls.WrapError(err)
+}
+
 func (c *Client) clientHandshake(conn *quic.Conn) error {
 	authStream, err := conn.OpenUniStream()
 	if err != nil {
@@ -207,60 +449,167 @@ func (c *Client) clientHandshake(conn *quic.Conn) error {
 }
 
 func (c *Client) DialConn(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
-	conn, err := c.offer(ctx)
+	tcpConn, err := c.openStream(ctx, destination, NetworkTCP)
 	if err != nil {
 		return nil, err
 	}
-	stream, err := conn.quicConn.OpenStream()
-	if err != nil {
-		return nil, err
-	}
-	return &clientConn{
-		Stream:      stream,
-		parent:      conn,
-		destination: destination,
-		network:     NetworkTCP,
-	}, nil
+	tcpConn.requestAccess.Lock()
+	tcpConn.flushTimer = time.AfterFunc(requestFlushDelay, tcpConn.flushRequest)
+	tcpConn.requestAccess.Unlock()
+	return tcpConn, nil
 }
 
 func (c *Client) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
-	conn, err := c.offer(ctx)
+	conn, err := c.openStream(ctx, destination, NetworkUDP)
 	if err != nil {
 		return nil, err
 	}
-	stream, err := conn.quicConn.OpenStream()
+	return &udpPacketConn{Conn: conn}, nil
+}
+
+// openStream waits for a free stream slot of the isolation tag and for the server to allow a new stream, until ctx is done.
+func (c *Client) openStream(ctx context.Context, destination metadata.Socksaddr, networkType int) (*clientConn, error) {
+	c.connAccess.Lock()
+	slot := c.slotLocked(IsolationTagFromContext(ctx))
+	slot.references++
+	c.connAccess.Unlock()
+	var acquired bool
+	releaseSlot := func() {
+		if acquired {
+			<-slot.streamSlots
+		}
+		c.connAccess.Lock()
+		slot.references--
+		c.collectSlotLocked(slot)
+		c.connAccess.Unlock()
+	}
+	if slot.streamSlots != nil {
+		select {
+		case slot.streamSlots <- struct{}{}:
+			acquired = true
+		case <-ctx.Done():
+			releaseSlot()
+			return nil, ctx.Err()
+		}
+	}
+	var conn *clientQUICConnection
+	for {
+		var err error
+		conn, err = c.offer(ctx)
+		if err != nil {
+			releaseSlot()
+			return nil, err
+		}
+		// The connection may start draining after it is offered, then a new one is offered.
+		if conn.acquireStream() {
+			break
+		}
+	}
+	stream, err := conn.quicConn.OpenStreamSync(ctx)
 	if err != nil {
-		return nil, err
+		conn.releaseStream()
+		releaseSlot()
+		return nil, wrapQUICError(err)
+	}
+	if c.metrics != nil {
+		c.metrics.StreamOpened(networkName(byte(networkType)))
 	}
-	return &udpPacketConn{
-		Conn: &clientConn{
-			Stream:      stream,
-			parent:      conn,
-			destination: destination,
-			network:     NetworkUDP,
-		},
+	return &clientConn{
+		Stream:      stream,
+		parent:      conn,
+		destination: destination,
+		network:     networkType,
+		requestDone: make(chan struct{}),
+		releaseSlot: releaseSlot,
 	}, nil
 }
 
 func (c *Client) CloseWithError(err error) error {
 	c.connAccess.Lock()
-	conn := c.conn
-	c.conn = nil
-	pending := c.pending
-	if pending != nil {
-		pending.discarded = true
-		pending.cause = err
+	slots := []*clientSlot{&c.defaultSlot}
+	for _, slot := range c.isolatedSlots {
+		slots = append(slots, slot)
+	}
+	c.isolatedSlots = nil
+	var (
+		conns    []*clientQUICConnection
+		pendings []*clientOffer
+	)
+	for _, slot := range slots {
+		for _, conn := range []*clientQUICConnection{slot.conn, slot.spare} {
+			if conn != nil {
+				conns = append(conns, conn)
+			}
+		}
+		for _, pending := range []*clientOffer{slot.pending, slot.pendingSpare} {
+			if pending != nil {
+				pending.discarded = true
+				pending.cause = err
+				pendings = append(pendings, pending)
+			}
+		}
+		slot.conn = nil
+		slot.spare = nil
 	}
 	c.connAccess.Unlock()
-	if pending != nil {
+	for _, pending := range pendings {
 		pending.cancel(err)
 	}
-	if conn != nil {
+	for _, conn := range conns {
 		conn.closeWithError(err)
 	}
 	return nil
 }
 
+// Rebind migrates the connections of the client to new UDP sockets, e.g. after the network of the device is changed.
+// Connections which fail to migrate are closed, so that new streams use new connections.
+func (c *Client) Rebind(ctx context.Context) error {
+	c.connAccess.Lock()
+	slots := []*clientSlot{&c.defaultSlot}
+	for _, slot := range c.isolatedSlots {
+		slots = append(slots, slot)
+	}
+	var conns []*clientQUICConnection
+	for _, slot := range slots {
+		for _, conn := range []*clientQUICConnection{slot.conn, slot.spare} {
+			if conn != nil && conn.active() {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	c.connAccess.Unlock()
+	var errors []error
+	for _, conn := range conns {
+		err := c.migrate(ctx, conn)
+		if err != nil {
+			err = exceptions.Cause(err, "migrate connection")
+			conn.closeWithError(err)
+			errors = append(errors, err)
+		}
+	}
+	return exceptions.Errors(errors...)
+}
+
+func (c *Client) migrate(ctx context.Context, conn *clientQUICConnection) error {
+	// Dial the address of the connection, which may differ from the one the dialer resolves ServerAddress to.
+	udpConn, err := c.dialer.DialContext(ctx, "udp", metadata.SocksaddrFromNet(conn.quicConn.RemoteAddr()).Unwrap())
+	if err != nil {
+		return err
+	}
+	conn.pathAccess.Lock()
+	conn.pathConns = append(conn.pathConns, udpConn)
+	conn.pathAccess.Unlock()
+	path, err := conn.quicConn.AddPath(&quic.Transport{Conn: bufio.NewUnbindPacketConn(udpConn)})
+	if err != nil {
+		return err
+	}
+	err = path.Probe(ctx)
+	if err != nil {
+		return err
+	}
+	return path.Switch()
+}
+
 type clientOffer struct {
 	done      chan struct{}
 	cancel    func(error)
@@ -271,11 +620,29 @@ type clientOffer struct {
 }
 
 type clientQUICConnection struct {
-	quicConn  *quic.Conn
-	rawConn   io.Closer
-	closeOnce sync.Once
-	connDone  chan struct{}
-	connErr   error
+	client            *Client
+	quicConn          *quic.Conn
+	rawConn           io.Closer
+	congestionControl string
+	metrics           ClientMetrics
+	closeOnce         sync.Once
+	connDone          chan struct{}
+	connErr           error
+	idleTimeout       time.Duration
+	maxStreams        int
+	responded         atomic.Bool
+
+	streamAccess  sync.Mutex
+	openStreams   int
+	totalStreams  int
+	draining      bool
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+
+	// pathConns are sockets of paths added by Client.Rebind. Previous sockets are kept open until the connection is closed,
+	// as closing them would close the connection.
+	pathAccess sync.Mutex
+	pathConns  []io.Closer
 }
 
 func (c *clientQUICConnection) active() bool {
@@ -289,56 +656,243 @@ func (c *clientQUICConnection) active() bool {
 		return false
 	default:
 	}
+	c.streamAccess.Lock()
+	defer c.streamAccess.Unlock()
+	return !c.draining
+}
+
+// acquireStream counts a new stream, and returns false if the connection is draining.
+func (c *clientQUICConnection) acquireStream() bool {
+	c.streamAccess.Lock()
+	defer c.streamAccess.Unlock()
+	if c.draining {
+		return false
+	}
+	c.openStreams++
+	c.totalStreams++
+	if c.maxStreams > 0 && c.totalStreams >= c.maxStreams {
+		c.draining = true
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
 	return true
 }
 
+// releaseStream closes a draining connection after its last stream is closed, and restarts the idle timer otherwise.
+func (c *clientQUICConnection) releaseStream() {
+	c.streamAccess.Lock()
+	c.openStreams--
+	drained := c.draining && c.openStreams == 0
+	if !drained && c.openStreams == 0 && c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+	c.streamAccess.Unlock()
+	if drained {
+		c.closeWithError(net.ErrClosed)
+	}
+}
+
+// drain stops offering the connection for new streams, and closes it after its streams are closed.
+func (c *clientQUICConnection) drain() {
+	c.streamAccess.Lock()
+	c.draining = true
+	drained := c.openStreams == 0
+	c.streamAccess.Unlock()
+	if drained {
+		c.closeWithError(net.ErrClosed)
+	}
+}
+
+func (c *clientQUICConnection) closeIdle() {
+	c.streamAccess.Lock()
+	idle := c.openStreams == 0
+	if idle {
+		c.draining = true
+	}
+	c.streamAccess.Unlock()
+	if idle {
+		c.closeWithError(net.ErrClosed)
+	}
+}
+
 func (c *clientQUICConnection) closeWithError(err error) {
 	c.closeOnce.Do(func() {
+		c.streamAccess.Lock()
+		c.draining = true
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		if c.lifetimeTimer != nil {
+			c.lifetimeTimer.Stop()
+		}
+		c.streamAccess.Unlock()
 		c.connErr = err
 		close(c.connDone)
-		_ = c.quicConn.CloseWithError(0, "")
+		_ = c.quicConn.CloseWithError(quic.ApplicationErrorCode(errorCodeFromError(err)), "")
 		_ = c.rawConn.Close()
+		c.pathAccess.Lock()
+		for _, pathConn := range c.pathConns {
+			_ = pathConn.Close()
+		}
+		c.pathAccess.Unlock()
+		if c.metrics != nil {
+			c.metrics.SessionClosed(c.congestionControl, c.quicConn.ConnectionStats())
+		}
+		c.client.connectionClosed(err)
 	})
 }
 
+// markResponded resets the reconnect backoff on the first response of the server, which proves authentication.
+func (c *clientQUICConnection) markResponded() {
+	if !c.responded.Load() && !c.responded.Swap(true) {
+		c.client.connectSucceeded()
+	}
+}
+
+// requestFlushDelay is how long a TCP stream waits for the first Write before sending the request without payload,
+// so that servers which speak first learn the destination.
+const requestFlushDelay = 100 * time.Millisecond
+
+var (
+	_ network.EarlyWriter = (*clientConn)(nil)
+	_ network.ReadCloser  = (*clientConn)(nil)
+	_ network.WriteCloser = (*clientConn)(nil)
+)
+
 type clientConn struct {
 	*quic.Stream
 	parent         *clientQUICConnection
 	destination    metadata.Socksaddr
-	requestWritten bool
+	requestAccess  sync.Mutex
+	requestClaimed bool
+	requestDone    chan struct{}
+	requestErr     error
+	requestWritten atomic.Bool
+	flushTimer     *time.Timer
+	closed         bool
 	network        int
+	uploaded       atomic.Int64
+	downloaded     atomic.Int64
+	releaseSlot    func()
+	closeOnce      sync.Once
+}
+
+func (c *clientConn) NeedHandshakeForWrite() bool {
+	return !c.requestWritten.Load()
 }
 
 func (c *clientConn) Read(b []byte) (int, error) {
+	if c.network == NetworkTCP && !c.requestWritten.Load() {
+		_, _, err := c.writeRequest(nil)
+		if err != nil {
+			return 0, err
+		}
+	}
 	n, err := c.Stream.Read(b)
+	if n > 0 {
+		c.parent.markResponded()
+	}
+	c.downloaded.Add(int64(n))
 	return n, wrapQUICError(err)
 }
 
 func (c *clientConn) Write(b []byte) (int, error) {
-	if !c.requestWritten {
-		request := buf.NewSize(1 + AddressSerializer.AddrPortLen(c.destination) + len(b))
-		defer request.Release()
-		request.WriteByte(byte(c.network))
-		err := AddressSerializer.WriteAddrPort(request, c.destination)
-		if err != nil {
-			return 0, wrapQUICError(err)
-		}
-		request.Write(b)
-		_, err = c.Stream.Write(request.Bytes())
-		if err != nil {
-			c.parent.closeWithError(exceptions.Cause(err, "create new connection"))
-			return 0, wrapQUICError(err)
+	if !c.requestWritten.Load() {
+		n, written, err := c.writeRequest(b)
+		if written {
+			return n, err
 		}
-		c.requestWritten = true
-		return len(b), nil
 	}
 	n, err := c.Stream.Write(b)
+	c.uploaded.Add(int64(n))
 	return n, wrapQUICError(err)
 }
 
+func (c *clientConn) flushRequest() {
+	_, _, _ = c.writeRequest(nil)
+}
+
+// writeRequest sends the request with payload, unless it has been sent. written reports whether payload is sent with the request.
+// If another call is sending the request, it waits for that call, so that payload is not written before the request.
+// c.requestAccess is not held while writing to the stream, so that Close is never blocked by flow control.
+func (c *clientConn) writeRequest(payload []byte) (n int, written bool, err error) {
+	c.requestAccess.Lock()
+	if c.requestClaimed {
+		c.requestAccess.Unlock()
+		<-c.requestDone
+		return 0, c.requestErr != nil, c.requestErr
+	}
+	if c.closed {
+		c.requestAccess.Unlock()
+		return 0, true, net.ErrClosed
+	}
+	c.requestClaimed = true
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+	}
+	c.requestAccess.Unlock()
+	defer close(c.requestDone)
+	request := buf.NewSize(1 + AddressSerializer.AddrPortLen(c.destination) + len(payload))
+	defer request.Release()
+	request.WriteByte(byte(c.network))
+	err = AddressSerializer.WriteAddrPort(request, c.destination)
+	if err != nil {
+		c.requestErr = wrapQUICError(err)
+		return 0, true, c.requestErr
+	}
+	request.Write(payload)
+	_, err = c.Stream.Write(request.Bytes())
+	if err != nil {
+		c.requestErr = wrapQUICError(err)
+		c.requestAccess.Lock()
+		closed := c.closed
+		c.requestAccess.Unlock()
+		// The stream is canceled by Close, which does not break the connection.
+		if !closed {
+			c.parent.closeWithError(exceptions.Cause(c.requestErr, "create new connection"))
+		}
+		return 0, true, c.requestErr
+	}
+	c.requestWritten.Store(true)
+	c.uploaded.Add(int64(len(payload)))
+	return len(payload), true, nil
+}
+
 func (c *clientConn) Close() error {
+	c.requestAccess.Lock()
+	c.closed = true
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+	}
+	c.requestAccess.Unlock()
 	c.Stream.CancelRead(0)
-	return c.Stream.Close()
+	err := c.Stream.Close()
+	c.closeOnce.Do(func() {
+		c.parent.releaseStream()
+		c.releaseSlot()
+		if c.parent.metrics != nil {
+			c.parent.metrics.BytesRelayed(networkName(byte(c.network)), c.uploaded.Load(), c.downloaded.Load())
+		}
+	})
+	return err
+}
+
+// CloseWrite closes the send side of the stream after sending the request, so that the server relays the half-close.
+func (c *clientConn) CloseWrite() error {
+	if !c.requestWritten.Load() {
+		_, _, err := c.writeRequest(nil)
+		if err != nil {
+			return err
+		}
+	}
+	return wrapQUICError(c.Stream.Close())
+}
+
+// CloseRead stops reading from the server, while the stream can still be written.
+func (c *clientConn) CloseRead() error {
+	c.Stream.CancelRead(0)
+	return nil
 }
 
 func (c *clientConn) LocalAddr() net.Addr {
@@ -0,0 +1,172 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"context"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// DestinationPolicy decides whether a stream may be relayed to a destination.
+// Rules are evaluated in order and the first matching rule wins.
+// CIDR rules only apply to IP destinations. Handlers resolving domain destinations must check the resolved addresses
+// with DestinationAddressAllowed, as DirectHandler does.
+type DestinationPolicy struct {
+	Rules []DestinationRule
+	// DefaultDeny denies destinations matching no rule.
+	DefaultDeny bool
+}
+
+// destinationPolicies is replaced as a whole, so that a stream never sees the global policy and the user policies of different updates.
+type destinationPolicies[U comparable] struct {
+	global *DestinationPolicy
+	users  map[U]*DestinationPolicy
+}
+
+// DestinationRule matches a destination if its address matches any of CIDRs, DomainSuffixes and DomainRegexes,
+// and its port is in any of Ports. Empty conditions match everything.
+type DestinationRule struct {
+	Deny           bool
+	CIDRs          []netip.Prefix
+	DomainSuffixes []string
+	DomainRegexes  []*regexp.Regexp
+	Ports          []PortRange
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+// PrivateDestinationRules returns rules denying destinations which should not be reachable from a public server:
+// unspecified, loopback, private, link-local, multicast and broadcast addresses, and port 0.
+func PrivateDestinationRules() []DestinationRule {
+	return []DestinationRule{
+		{
+			Deny: true,
+			CIDRs: []netip.Prefix{
+				netip.MustParsePrefix("0.0.0.0/8"),
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("100.64.0.0/10"),
+				netip.MustParsePrefix("127.0.0.0/8"),
+				netip.MustParsePrefix("169.254.0.0/16"),
+				netip.MustParsePrefix("172.16.0.0/12"),
+				netip.MustParsePrefix("192.168.0.0/16"),
+				netip.MustParsePrefix("224.0.0.0/4"),
+				netip.MustParsePrefix("240.0.0.0/4"), // including 255.255.255.255
+				netip.MustParsePrefix("::/128"),
+				netip.MustParsePrefix("::1/128"),
+				netip.MustParsePrefix("fc00::/7"),
+				netip.MustParsePrefix("fe80::/10"),
+				netip.MustParsePrefix("ff00::/8"),
+			},
+		},
+		{
+			Deny:  true,
+			Ports: []PortRange{{0, 0}},
+		},
+	}
+}
+
+func (p *DestinationPolicy) allowed(destination metadata.Socksaddr) bool {
+	if p == nil {
+		return true
+	}
+	for index := range p.Rules {
+		if p.Rules[index].match(destination) {
+			return !p.Rules[index].Deny
+		}
+	}
+	return !p.DefaultDeny
+}
+
+// addressAllowed is like allowed, but address is resolved from an allowed domain, so it is only denied by a matching rule.
+func (p *DestinationPolicy) addressAllowed(address metadata.Socksaddr) bool {
+	if p == nil {
+		return true
+	}
+	for index := range p.Rules {
+		if p.Rules[index].match(address) {
+			return !p.Rules[index].Deny
+		}
+	}
+	return true
+}
+
+type destinationFilterKey struct{}
+
+func contextWithDestinationFilter(ctx context.Context, filter func(address metadata.Socksaddr) bool) context.Context {
+	return context.WithValue(ctx, destinationFilterKey{}, filter)
+}
+
+func destinationFilterFromContext(ctx context.Context) func(address metadata.Socksaddr) bool {
+	filter, _ := ctx.Value(destinationFilterKey{}).(func(address metadata.Socksaddr) bool)
+	return filter
+}
+
+// DestinationAddressAllowed reports whether the destination policies of the stream of ctx allow address,
+// which is resolved from the domain destination of the stream. It returns true if ctx is not from a Service.
+func DestinationAddressAllowed(ctx context.Context, address metadata.Socksaddr) bool {
+	filter := destinationFilterFromContext(ctx)
+	return filter == nil || filter(address)
+}
+
+func (r *DestinationRule) match(destination metadata.Socksaddr) bool {
+	if len(r.Ports) > 0 {
+		var portMatched bool
+		for _, portRange := range r.Ports {
+			if destination.Port >= portRange.Start && destination.Port <= portRange.End {
+				portMatched = true
+				break
+			}
+		}
+		if !portMatched {
+			return false
+		}
+	}
+	if len(r.CIDRs) == 0 && len(r.DomainSuffixes) == 0 && len(r.DomainRegexes) == 0 {
+		return true
+	}
+	if destination.IsIP() {
+		addr := destination.Addr.Unmap()
+		for _, prefix := range r.CIDRs {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(destination.Fqdn, "."))
+	for _, suffix := range r.DomainSuffixes {
+		suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	for _, domainRegex := range r.DomainRegexes {
+		if domainRegex.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"net/netip"
+	"regexp"
+	"testing"
+
+	"github.com/sagernet/sing/common/metadata"
+)
+
+func TestDestinationPolicy(t *testing.T) {
+	policy := &DestinationPolicy{
+		Rules: []DestinationRule{
+			{DomainSuffixes: []string{"allowed.example.com"}},
+			{Deny: true, DomainSuffixes: []string{".Example.COM"}},
+			{Deny: true, DomainRegexes: []*regexp.Regexp{regexp.MustCompile(`^ads\.`)}},
+			{CIDRs: []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}},
+			{Deny: true, CIDRs: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}},
+			{Deny: true, Ports: []PortRange{{25, 25}, {6000, 6999}}},
+			{Deny: true, CIDRs: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}, Ports: []PortRange{{443, 443}}},
+		},
+	}
+	for _, testCase := range []struct {
+		destination string
+		allowed     bool
+	}{
+		{"example.com:80", false},
+		{"EXAMPLE.com.:80", false},
+		{"www.example.com:80", false},
+		{"allowed.example.com:80", true},
+		{"sub.allowed.example.com:25", true}, // the first matching rule wins
+		{"notexample.com:80", true},
+		{"ads.example.org:80", false},
+		{"192.0.2.1:80", true},
+		{"192.0.2.2:80", false},
+		{"[::ffff:192.0.2.2]:80", false},
+		{"203.0.113.1:25", false},
+		{"203.0.113.1:6500", false},
+		{"203.0.113.1:7000", true},
+		{"198.51.100.1:443", false},
+		{"198.51.100.1:80", true},
+	} {
+		allowed := policy.allowed(metadata.ParseSocksaddr(testCase.destination))
+		if allowed != testCase.allowed {
+			t.Errorf("allowed(%s) = %v, want %v", testCase.destination, allowed, testCase.allowed)
+		}
+	}
+}
+
+func TestDestinationPolicyDefaultDeny(t *testing.T) {
+	var nilPolicy *DestinationPolicy
+	if !nilPolicy.allowed(metadata.ParseSocksaddr("127.0.0.1:80")) || !nilPolicy.addressAllowed(metadata.ParseSocksaddr("127.0.0.1:80")) {
+		t.Fatal("nil policy denies")
+	}
+	policy := &DestinationPolicy{
+		Rules:       append([]DestinationRule{{DomainSuffixes: []string{"example.com"}}}, PrivateDestinationRules()...),
+		DefaultDeny: true,
+	}
+	for _, testCase := range []struct {
+		destination    string
+		allowed        bool
+		addressAllowed bool
+	}{
+		{"example.com:80", true, true},
+		{"example.org:80", false, true},
+		{"203.0.113.1:80", false, true}, // resolved from an allowed domain
+		{"127.0.0.1:80", false, false},
+		{"[::1]:80", false, false},
+		{"[::ffff:10.0.0.1]:80", false, false},
+		{"[fe80::1]:80", false, false},
+		{"203.0.113.1:0", false, false},
+	} {
+		destination := metadata.ParseSocksaddr(testCase.destination)
+		if allowed := policy.allowed(destination); allowed != testCase.allowed {
+			t.Errorf("allowed(%s) = %v, want %v", testCase.destination, allowed, testCase.allowed)
+		}
+		if allowed := policy.addressAllowed(destination); allowed != testCase.addressAllowed {
+			t.Errorf("addressAllowed(%s) = %v, want %v", testCase.destination, allowed, testCase.addressAllowed)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/cache"
+	"github.com/sagernet/sing/common/canceler"
+	"github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/network"
+)
+
+var _ ServiceHandler = (*DirectHandler)(nil)
+
+// DomainStrategy selects the addresses of domain destinations dialed by DirectHandler.
+type DomainStrategy uint8
+
+const (
+	// DomainStrategyAsIs uses addresses in the order returned by the resolver. TCP domains are left to the dialer,
+	// unless the stream is from a Service, whose destination policies are checked on the resolved addresses.
+	DomainStrategyAsIs DomainStrategy = iota
+	DomainStrategyPreferIPv4
+	DomainStrategyPreferIPv6
+	DomainStrategyIPv4Only
+	DomainStrategyIPv6Only
+)
+
+type DirectHandlerOptions struct {
+	Logger logger.Logger
+	// Dialer defaults to network.SystemDialer.
+	Dialer network.Dialer
+	// Resolver resolves domain destinations, default net.DefaultResolver.
+	Resolver       *net.Resolver
+	DomainStrategy DomainStrategy
+	// DialTimeout limits resolving and dialing a TCP destination, default 10 seconds.
+	DialTimeout time.Duration
+	// UDPTimeout closes UDP streams without packets in either direction, default 5 minutes.
+	UDPTimeout time.Duration
+}
+
+// DirectHandler is a ServiceHandler relaying streams directly to their destinations.
+type DirectHandler struct {
+	logger         logger.Logger
+	dialer         network.Dialer
+	resolver       *net.Resolver
+	domainStrategy DomainStrategy
+	dialTimeout    time.Duration
+	udpTimeout     time.Duration
+}
+
+func NewDirectHandler(options DirectHandlerOptions) *DirectHandler {
+	if options.Logger == nil {
+		options.Logger = logger.NOP()
+	}
+	if options.Dialer == nil {
+		options.Dialer = network.SystemDialer
+	}
+	if options.Resolver == nil {
+		options.Resolver = net.DefaultResolver
+	}
+	if options.DialTimeout == 0 {
+		options.DialTimeout = 10 * time.Second
+	}
+	if options.UDPTimeout == 0 {
+		options.UDPTimeout = 5 * time.Minute
+	}
+	return &DirectHandler{
+		logger:         options.Logger,
+		dialer:         options.Dialer,
+		resolver:       options.Resolver,
+		domainStrategy: options.DomainStrategy,
+		dialTimeout:    options.DialTimeout,
+		udpTimeout:     options.UDPTimeout,
+	}
+}
+
+func (h *DirectHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source metadata.Socksaddr, destination metadata.Socksaddr, onClose network.CloseHandlerFunc) {
+	remoteConn, err := h.dialTCP(ctx, destination)
+	if err != nil {
+		err = exceptions.Cause(err, "dial ", destination)
+		h.logger.Debug(err)
+		network.CloseOnHandshakeFailure(conn, onClose, err)
+		return
+	}
+	err = bufio.CopyConn(ctx, conn, remoteConn)
+	if err != nil && !exceptions.IsClosedOrCanceled(err) {
+		h.logger.Debug(exceptions.Cause(err, "relay ", source, " => ", destination))
+	}
+	if onClose != nil {
+		onClose(err)
+	}
+}
+
+func (h *DirectHandler) NewPacketConnectionEx(ctx context.Context, conn network.PacketConn, source metadata.Socksaddr, destination metadata.Socksaddr, onClose network.CloseHandlerFunc) {
+	udpConn, err := h.dialer.ListenPacket(ctx, destination)
+	if err != nil {
+		err = exceptions.Cause(err, "listen packet for ", destination)
+		h.logger.Debug(err)
+		network.CloseOnHandshakeFailure(conn, onClose, err)
+		return
+	}
+	// canceler.NewPacketConn is not used, as its deadline based implementation is racy.
+	ctx, cancel := common.ContextWithCancelCause(ctx)
+	remoteConn := &directPacketConn{
+		PacketConn: bufio.NewPacketConn(udpConn),
+		ctx:        ctx,
+		handler:    h,
+		idle:       canceler.New(ctx, cancel, h.udpTimeout),
+		domains: cache.New(
+			cache.WithSize[netip.AddrPort, metadata.Socksaddr](directCacheSize),
+			cache.WithAge[netip.AddrPort, metadata.Socksaddr](int64(h.udpTimeout/time.Second)),
+			cache.WithUpdateAgeOnGet[netip.AddrPort, metadata.Socksaddr](),
+		),
+		addresses: cache.New(
+			cache.WithSize[string, *directResolveResult](directCacheSize),
+			cache.WithAge[string, *directResolveResult](int64(directResolveTTL/time.Second)),
+		),
+	}
+	err = bufio.CopyPacketConn(ctx, conn, remoteConn)
+	remoteConn.idle.Close()
+	if err != nil && !exceptions.IsClosedOrCanceled(err) {
+		h.logger.Debug(exceptions.Cause(err, "relay packets ", source, " => ", destination))
+	}
+	if onClose != nil {
+		onClose(err)
+	}
+}
+
+func (h *DirectHandler) dialTCP(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.dialTimeout)
+	defer cancel()
+	if !destination.IsFqdn() || h.domainStrategy == DomainStrategyAsIs && destinationFilterFromContext(ctx) == nil {
+		return h.dialer.DialContext(ctx, network.NetworkTCP, destination)
+	}
+	addresses, err := h.lookup(ctx, destination.Fqdn)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err = filterAddresses(ctx, destination, addresses)
+	if err != nil {
+		return nil, err
+	}
+	// network.DialSerial is not used, as it recurses forever with network.SystemDialer.
+	var errors []error
+	for _, address := range addresses {
+		conn, err := h.dialer.DialContext(ctx, network.NetworkTCP, metadata.Socksaddr{Addr: address, Port: destination.Port})
+		if err == nil {
+			return conn, nil
+		}
+		errors = append(errors, err)
+	}
+	return nil, exceptions.Errors(errors...)
+}
+
+// lookup returns the addresses of domain ordered by the domain strategy.
+func (h *DirectHandler) lookup(ctx context.Context, domain string) ([]netip.Addr, error) {
+	lookupNetwork := "ip"
+	switch h.domainStrategy {
+	case DomainStrategyIPv4Only:
+		lookupNetwork = "ip4"
+	case DomainStrategyIPv6Only:
+		lookupNetwork = "ip6"
+	}
+	addresses, err := h.resolver.LookupNetIP(ctx, lookupNetwork, domain)
+	if err != nil {
+		return nil, err
+	}
+	var ipv4Addresses, ipv6Addresses []netip.Addr
+	for _, address := range addresses {
+		address = address.Unmap()
+		if address.Is4() {
+			ipv4Addresses = append(ipv4Addresses, address)
+		} else {
+			ipv6Addresses = append(ipv6Addresses, address)
+		}
+	}
+	switch h.domainStrategy {
+	case DomainStrategyPreferIPv4:
+		addresses = append(ipv4Addresses, ipv6Addresses...)
+	case DomainStrategyPreferIPv6:
+		addresses = append(ipv6Addresses, ipv4Addresses...)
+	case DomainStrategyIPv4Only:
+		addresses = ipv4Addresses
+	case DomainStrategyIPv6Only:
+		addresses = ipv6Addresses
+	}
+	if len(addresses) == 0 {
+		return nil, exceptions.Extend(ErrHostUnreachable, "no suitable address for ", domain)
+	}
+	return addresses, nil
+}
+
+// filterAddresses drops the addresses of a domain destination denied by the destination policies of the stream of ctx.
+func filterAddresses(ctx context.Context, destination metadata.Socksaddr, addresses []netip.Addr) ([]netip.Addr, error) {
+	allowed := make([]netip.Addr, 0, len(addresses))
+	for _, address := range addresses {
+		if DestinationAddressAllowed(ctx, metadata.Socksaddr{Addr: address, Port: destination.Port}) {
+			allowed = append(allowed, address)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, exceptions.Extend(ErrDestinationDenied, "all addresses of ", destination)
+	}
+	return allowed, nil
+}
+
+const (
+	// directCacheSize limits the domains cached by each UDP stream of DirectHandler.
+	directCacheSize = 256
+	// directResolveTTL and directResolveFailureTTL are how long addresses and failures of resolving UDP destinations are cached,
+	// as net.Resolver does not expose the TTL of records.
+	directResolveTTL        = time.Minute
+	directResolveFailureTTL = 10 * time.Second
+)
+
+// directPacketConn resolves domain destinations of outgoing packets, and reports replies from a resolved address
+// as from the domain, so that clients can match them with their requests.
+// Domains are resolved in the background, so that an unresponsive resolver does not block packets to other destinations.
+// Only network.PacketConn is embedded, so that bufio cannot bypass it with a syscall read waiter.
+type directPacketConn struct {
+	network.PacketConn
+	ctx     context.Context
+	handler *DirectHandler
+	idle    *canceler.Instance
+
+	domains   *cache.LruCache[netip.AddrPort, metadata.Socksaddr]
+	addresses *cache.LruCache[string, *directResolveResult]
+}
+
+// directResolveResult is the result of resolving a domain, available after done is closed.
+type directResolveResult struct {
+	done      chan struct{}
+	addresses []netip.Addr
+	err       error
+
+	// pending is the last packet written while resolving, which is sent once resolved. Earlier packets are dropped.
+	access             sync.Mutex
+	pending            *buf.Buffer
+	pendingDestination metadata.Socksaddr
+}
+
+func (c *directPacketConn) ReadPacket(buffer *buf.Buffer) (destination metadata.Socksaddr, err error) {
+	destination, err = c.PacketConn.ReadPacket(buffer)
+	if err != nil {
+		return
+	}
+	c.idle.Update()
+	destination = destination.Unwrap()
+	domain, loaded := c.domains.Load(destination.AddrPort())
+	if loaded {
+		destination = domain
+	}
+	return
+}
+
+func (c *directPacketConn) WritePacket(buffer *buf.Buffer, destination metadata.Socksaddr) error {
+	if !destination.IsFqdn() {
+		err := c.PacketConn.WritePacket(buffer, destination)
+		if err == nil {
+			c.idle.Update()
+		}
+		return err
+	}
+	result, loaded := c.addresses.LoadOrStore(destination.Fqdn, func() *directResolveResult {
+		return &directResolveResult{done: make(chan struct{})}
+	})
+	if !loaded {
+		go c.resolve(destination.Fqdn, result)
+	}
+	result.access.Lock()
+	select {
+	case <-result.done:
+		result.access.Unlock()
+		return c.writeResolved(buffer, destination, result)
+	default:
+	}
+	if result.pending != nil {
+		result.pending.Release()
+	}
+	result.pending = buffer
+	result.pendingDestination = destination
+	result.access.Unlock()
+	return nil
+}
+
+func (c *directPacketConn) resolve(domain string, result *directResolveResult) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.handler.dialTimeout)
+	result.addresses, result.err = c.handler.lookup(ctx, domain)
+	cancel()
+	if result.err != nil {
+		c.addresses.StoreWithExpire(domain, result, time.Now().Add(directResolveFailureTTL))
+	}
+	result.access.Lock()
+	close(result.done)
+	pending, destination := result.pending, result.pendingDestination
+	result.pending = nil
+	result.access.Unlock()
+	if pending == nil {
+		return
+	}
+	err := c.writeResolved(pending, destination, result)
+	if err != nil && !exceptions.IsClosedOrCanceled(err) {
+		c.handler.logger.Debug(exceptions.Cause(err, "write packet to ", destination))
+	}
+}
+
+// writeResolved sends buffer to the first address of destination allowed by the destination policies for its port.
+// If there is none, the packet is dropped instead of closing the stream, which may relay packets to other destinations.
+func (c *directPacketConn) writeResolved(buffer *buf.Buffer, destination metadata.Socksaddr, result *directResolveResult) error {
+	addresses, err := result.addresses, result.err
+	if err == nil {
+		addresses, err = filterAddresses(c.ctx, destination, addresses)
+	}
+	if err != nil {
+		buffer.Release()
+		c.handler.logger.Debug(exceptions.Cause(err, "resolve ", destination))
+		return nil
+	}
+	addrPort := netip.AddrPortFrom(addresses[0], destination.Port)
+	c.domains.Store(addrPort, destination)
+	err = c.PacketConn.WritePacket(buffer, metadata.SocksaddrFromNetIP(addrPort))
+	if err == nil {
+		c.idle.Update()
+	}
+	return err
+}
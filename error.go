@@ -0,0 +1,195 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/sagernet/quic-go"
+	"github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/format"
+)
+
+// ErrorCode is sent as the QUIC application error code when a connection or a stream is closed.
+// These codes are not part of Juicity Specification. The official Juicity implementation always sends 0,
+// and treats any other code as a generic error.
+type ErrorCode uint64
+
+const (
+	ErrorCodeNone ErrorCode = iota
+	ErrorCodeAuthTimeout
+	// ErrorCodeUnknownUser and ErrorCodeTokenMismatch are not sent by Service, which sends ErrorCodeAuthFailed for both
+	// so that valid UUIDs cannot be enumerated.
+	ErrorCodeUnknownUser
+	ErrorCodeTokenMismatch
+	ErrorCodeUnknownCommand
+	ErrorCodeUnsupportedNetwork
+	ErrorCodeQuotaExceeded
+	ErrorCodeServerShutdown
+	ErrorCodeDestinationDenied
+	ErrorCodeAuthThrottled
+	ErrorCodeAuthFailed
+	ErrorCodeUserExpired
+	// ErrorCodeConnectionRefused, ErrorCodeHostUnreachable and ErrorCodeConnectionTimeout reset streams
+	// whose destination cannot be reached by the server.
+	ErrorCodeConnectionRefused
+	ErrorCodeHostUnreachable
+	ErrorCodeConnectionTimeout
+)
+
+var (
+	ErrAuthTimeout              = errors.New("authentication timeout")
+	ErrUnknownUser              = errors.New("unknown user")
+	ErrTokenMismatch            = errors.New("token mismatch")
+	ErrUnknownCommand           = errors.New("unknown command")
+	ErrUnsupportedNetwork       = errors.New("unsupported network")
+	ErrQuotaExceeded            = errors.New("quota exceeded")
+	ErrServerShutdown           = errors.New("server shutdown")
+	ErrDestinationDenied        = errors.New("destination denied")
+	ErrAuthThrottled            = errors.New("too many authentication failures")
+	ErrAuthFailed               = errors.New("authentication failed")
+	ErrUserExpired              = errors.New("user expired or not yet valid")
+	ErrConnectionRefused        = errors.New("connection refused")
+	ErrHostUnreachable          = errors.New("host unreachable")
+	ErrConnectionTimeout        = errors.New("connection timed out")
+	ErrMultipleAuthentication   = errors.New("multiple authentication requests")
+	ErrUnknownCongestionControl = errors.New("unknown congestion control algorithm")
+	ErrReconnectBackoff         = errors.New("waiting to reconnect after failures")
+)
+
+var errorCodeErrors = [...]error{
+	ErrorCodeAuthTimeout:        ErrAuthTimeout,
+	ErrorCodeUnknownUser:        ErrUnknownUser,
+	ErrorCodeTokenMismatch:      ErrTokenMismatch,
+	ErrorCodeUnknownCommand:     ErrUnknownCommand,
+	ErrorCodeUnsupportedNetwork: ErrUnsupportedNetwork,
+	ErrorCodeQuotaExceeded:      ErrQuotaExceeded,
+	ErrorCodeServerShutdown:     ErrServerShutdown,
+	ErrorCodeDestinationDenied:  ErrDestinationDenied,
+	ErrorCodeAuthThrottled:      ErrAuthThrottled,
+	ErrorCodeAuthFailed:         ErrAuthFailed,
+	ErrorCodeUserExpired:        ErrUserExpired,
+	ErrorCodeConnectionRefused:  ErrConnectionRefused,
+	ErrorCodeHostUnreachable:    ErrHostUnreachable,
+	ErrorCodeConnectionTimeout:  ErrConnectionTimeout,
+}
+
+func (c ErrorCode) String() string {
+	if c == ErrorCodeNone {
+		return "no error"
+	}
+	if c < ErrorCode(len(errorCodeErrors)) {
+		return errorCodeErrors[c].Error()
+	}
+	return format.ToString("unknown error code ", uint64(c))
+}
+
+// VersionError is returned when a request carries an unsupported protocol version.
+type VersionError struct {
+	Version byte
+}
+
+func (e *VersionError) Error() string {
+	return format.ToString("unknown version ", e.Version)
+}
+
+// ApplicationError is a Juicity error code carried by a closed QUIC connection or stream.
+// Remote is true if the code was received from the peer.
+type ApplicationError struct {
+	Code   ErrorCode
+	Remote bool
+}
+
+func (e *ApplicationError) Error() string {
+	if e.Remote {
+		return "remote: " + e.Code.String()
+	}
+	return e.Code.String()
+}
+
+// Unwrap returns the sentinel error of the code, so errors.Is works on both local and remote errors.
+func (e *ApplicationError) Unwrap() error {
+	if e.Code == ErrorCodeNone || e.Code >= ErrorCode(len(errorCodeErrors)) {
+		return nil
+	}
+	return errorCodeErrors[e.Code]
+}
+
+// errorCodeFromError returns the code to send to the peer when closing because of err.
+func errorCodeFromError(err error) ErrorCode {
+	var appErr *ApplicationError
+	if errors.As(err, &appErr) {
+		if appErr.Remote {
+			return ErrorCodeNone
+		}
+		return appErr.Code
+	}
+	for code, codeErr := range errorCodeErrors {
+		if codeErr != nil && errors.Is(err, codeErr) {
+			return ErrorCode(code)
+		}
+	}
+	return ErrorCodeNone
+}
+
+// streamErrorCodeFromError is like errorCodeFromError, but also recognizes errors from dialing the destination of a stream.
+func streamErrorCodeFromError(err error) ErrorCode {
+	code := errorCodeFromError(err)
+	if code != ErrorCodeNone {
+		return code
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorCodeConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return ErrorCodeHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorCodeConnectionTimeout
+	}
+	return ErrorCodeNone
+}
+
+// authFailedError wraps an authentication failure so that ErrorCodeAuthFailed is sent regardless of cause,
+// while errors.Is still matches cause locally.
+func authFailedError(cause error) error {
+	return exceptions.Cause1(&ApplicationError{Code: ErrorCodeAuthFailed}, cause)
+}
+
+// applicationErrorFromQUIC converts a QUIC connection or stream error with a non-zero code to *ApplicationError.
+func applicationErrorFromQUIC(err error) *ApplicationError {
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		if streamErr.ErrorCode == 0 {
+			return nil
+		}
+		return &ApplicationError{Code: ErrorCode(streamErr.ErrorCode), Remote: streamErr.Remote}
+	}
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		if appErr.ErrorCode == 0 {
+			return nil
+		}
+		return &ApplicationError{Code: ErrorCode(appErr.ErrorCode), Remote: appErr.Remote}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"context"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// ServiceEvents receives session lifecycle events of a Service.
+// Once a session is authenticated, the user can be retrieved from ctx with auth.UserFromContext.
+// Methods are called synchronously from the session goroutines and must not block.
+type ServiceEvents interface {
+	ConnectionAccepted(ctx context.Context, source metadata.Socksaddr)
+	AuthSucceeded(ctx context.Context, source metadata.Socksaddr)
+	AuthFailed(ctx context.Context, source metadata.Socksaddr, err error)
+	// network is network.NetworkTCP or network.NetworkUDP.
+	StreamOpened(ctx context.Context, network string, source metadata.Socksaddr, destination metadata.Socksaddr)
+	// uploaded is the number of bytes read from the client, downloaded is the number of bytes written to the client.
+	StreamClosed(ctx context.Context, network string, source metadata.Socksaddr, destination metadata.Socksaddr, uploaded int64, downloaded int64, duration time.Duration)
+	SessionClosed(ctx context.Context, source metadata.Socksaddr, err error)
+}
+
+// ClientEvents receives connection state changes of a Client, e.g. to show the connection status.
+// Methods are called synchronously and must not block, but they may call methods of the Client, such as CircuitState.
+type ClientEvents interface {
+	// Connected is called when the client has a connection to the server, after having none.
+	Connected()
+	// Disconnected is called when the last connection of the client is closed, with the error closing it.
+	Disconnected(err error)
+	// AuthFailed is called when a connection is closed by the server for an authentication failure, before Disconnected.
+	AuthFailed(err error)
+}
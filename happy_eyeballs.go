@@ -0,0 +1,137 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/sagernet/quic-go"
+	"github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// dialServer dials the UDP socket and the QUIC connection to the server, racing the addresses of a domain if Happy Eyeballs is enabled.
+func (c *Client) dialServer(ctx context.Context, quicConfig *quic.Config) (net.Conn, *quic.Conn, error) {
+	if c.happyDelay == 0 || c.resolver == nil || !c.serverAddr.IsFqdn() {
+		return c.dialServerAddr(ctx, c.serverAddr, quicConfig)
+	}
+	addresses, err := c.resolver.LookupNetIP(ctx, "ip", c.serverAddr.Fqdn)
+	if err != nil {
+		return nil, nil, exceptions.Cause(err, "resolve ", c.serverAddr.Fqdn)
+	}
+	return c.raceServerAddrs(ctx, c.sortAddresses(addresses), quicConfig)
+}
+
+// raceServerAddrs starts handshakes to addresses in order with a staggered start, and returns the first one to succeed.
+func (c *Client) raceServerAddrs(ctx context.Context, addresses []netip.Addr, quicConfig *quic.Config) (net.Conn, *quic.Conn, error) {
+	type dialResult struct {
+		address  netip.Addr
+		udpConn  net.Conn
+		quicConn *quic.Conn
+		err      error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addresses))
+	nextAttempt := time.NewTimer(0)
+	defer nextAttempt.Stop()
+	var (
+		started  int
+		finished int
+		errors   []error
+	)
+	for finished < len(addresses) {
+		var attemptChan <-chan time.Time
+		if started < len(addresses) {
+			attemptChan = nextAttempt.C
+		}
+		select {
+		case <-attemptChan:
+			address := addresses[started]
+			started++
+			go func() {
+				udpConn, quicConn, err := c.dialServerAddr(ctx, metadata.Socksaddr{Addr: address, Port: c.serverAddr.Port}, quicConfig)
+				results <- dialResult{address, udpConn, quicConn, err}
+			}()
+			nextAttempt.Reset(c.happyDelay)
+		case result := <-results:
+			finished++
+			if result.err != nil {
+				errors = append(errors, result.err)
+				// Start the next attempt without waiting for the delay, as RFC 8305 does.
+				if started < len(addresses) {
+					nextAttempt.Reset(0)
+				}
+				continue
+			}
+			c.preferIPv4.Store(result.address.Is4())
+			// Close connections of attempts which succeed after the winner.
+			go func(pending int) {
+				for range pending {
+					result := <-results
+					if result.err == nil {
+						_ = result.quicConn.CloseWithError(0, "")
+						_ = result.udpConn.Close()
+					}
+				}
+			}(started - finished)
+			return result.udpConn, result.quicConn, nil
+		}
+	}
+	return nil, nil, exceptions.Errors(errors...)
+}
+
+func (c *Client) dialServerAddr(ctx context.Context, destination metadata.Socksaddr, quicConfig *quic.Config) (net.Conn, *quic.Conn, error) {
+	udpConn, err := c.dialer.DialContext(ctx, "udp", destination)
+	if err != nil {
+		return nil, nil, err
+	}
+	quicConn, err := c.dialQUIC(ctx, udpConn, quicConfig)
+	if err != nil {
+		udpConn.Close()
+		return nil, nil, exceptions.Cause(err, "open connection")
+	}
+	return udpConn, quicConn, nil
+}
+
+// sortAddresses interleaves IPv6 and IPv4 addresses, starting with the preferred family, which is IPv6 until an IPv4 attempt wins.
+func (c *Client) sortAddresses(addresses []netip.Addr) []netip.Addr {
+	var primary, secondary []netip.Addr
+	preferIPv4 := c.preferIPv4.Load()
+	for _, address := range addresses {
+		address = address.Unmap()
+		if address.Is4() == preferIPv4 {
+			primary = append(primary, address)
+		} else {
+			secondary = append(secondary, address)
+		}
+	}
+	sorted := make([]netip.Addr, 0, len(addresses))
+	for index := 0; index < len(primary) || index < len(secondary); index++ {
+		if index < len(primary) {
+			sorted = append(sorted, primary[index])
+		}
+		if index < len(secondary) {
+			sorted = append(sorted, secondary[index])
+		}
+	}
+	return sorted
+}
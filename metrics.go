@@ -0,0 +1,76 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sagernet/quic-go"
+)
+
+// ServiceMetrics collects server-wide metrics of a Service.
+// Methods must be safe for concurrent use and must not block.
+type ServiceMetrics interface {
+	SessionOpened()
+	// SessionClosed reports the QUIC statistics of the closed session, keyed by its congestion control algorithm.
+	SessionClosed(congestionControl string, stats quic.ConnectionStats)
+	// AuthAttempt reports the result of an authentication attempt, see AuthResult.
+	AuthAttempt(result string)
+	// HandshakeDuration reports the time from accepting a connection to its successful authentication.
+	HandshakeDuration(duration time.Duration)
+	StreamOpened(network string)
+	BytesRelayed(network string, uploaded int64, downloaded int64)
+	AcceptError()
+}
+
+// ClientMetrics collects metrics of a Client.
+// Methods must be safe for concurrent use and must not block.
+type ClientMetrics interface {
+	SessionOpened()
+	// SessionClosed reports the QUIC statistics of the closed connection, keyed by its congestion control algorithm.
+	SessionClosed(congestionControl string, stats quic.ConnectionStats)
+	// HandshakeDuration reports the time spent on dialing and the QUIC handshake.
+	HandshakeDuration(duration time.Duration)
+	StreamOpened(network string)
+	BytesRelayed(network string, uploaded int64, downloaded int64)
+	DialError()
+}
+
+// AuthResult returns the label reported to ServiceMetrics.AuthAttempt for an authentication error.
+func AuthResult(err error) string {
+	if err == nil {
+		return "success"
+	}
+	switch {
+	case errors.Is(err, ErrUnknownUser):
+		return "unknown_user"
+	case errors.Is(err, ErrTokenMismatch):
+		return "token_mismatch"
+	}
+	code := errorCodeFromError(err)
+	if code == ErrorCodeNone {
+		var versionErr *VersionError
+		if errors.As(err, &versionErr) {
+			return "unknown_version"
+		}
+		return "error"
+	}
+	return strings.ReplaceAll(code.String(), " ", "_")
+}
@@ -0,0 +1,249 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/quic-go"
+)
+
+var (
+	_ ServiceMetrics = (*PrometheusMetrics)(nil)
+	_ ClientMetrics  = (*PrometheusMetrics)(nil)
+	_ http.Handler   = (*PrometheusMetrics)(nil)
+)
+
+var prometheusDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type prometheusCongestionStats struct {
+	sessions       uint64
+	bytesSent      uint64
+	bytesLost      uint64
+	packetsSent    uint64
+	packetsLost    uint64
+	smoothedRTTSum float64
+}
+
+// PrometheusMetrics is a ServiceMetrics and ClientMetrics which exports metrics in the Prometheus text exposition format.
+type PrometheusMetrics struct {
+	namespace string
+
+	access             sync.Mutex
+	activeSessions     int64
+	authAttempts       map[string]uint64
+	streams            map[string]uint64
+	uploaded           map[string]uint64
+	downloaded         map[string]uint64
+	handshakeBuckets   []uint64
+	handshakeSum       float64
+	handshakeCount     uint64
+	acceptErrors       uint64
+	dialErrors         uint64
+	congestionStatsMap map[string]*prometheusCongestionStats
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics. All metric names are prefixed with namespace, e.g. `juicity_server`.
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		namespace:          namespace,
+		authAttempts:       make(map[string]uint64),
+		streams:            make(map[string]uint64),
+		uploaded:           make(map[string]uint64),
+		downloaded:         make(map[string]uint64),
+		handshakeBuckets:   make([]uint64, len(prometheusDurationBuckets)),
+		congestionStatsMap: make(map[string]*prometheusCongestionStats),
+	}
+}
+
+func (m *PrometheusMetrics) SessionOpened() {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.activeSessions++
+}
+
+func (m *PrometheusMetrics) SessionClosed(congestionControl string, stats quic.ConnectionStats) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.activeSessions--
+	congestionStats := m.congestionStatsMap[congestionControl]
+	if congestionStats == nil {
+		congestionStats = &prometheusCongestionStats{}
+		m.congestionStatsMap[congestionControl] = congestionStats
+	}
+	congestionStats.sessions++
+	congestionStats.bytesSent += stats.BytesSent
+	congestionStats.bytesLost += stats.BytesLost
+	congestionStats.packetsSent += stats.PacketsSent
+	congestionStats.packetsLost += stats.PacketsLost
+	congestionStats.smoothedRTTSum += stats.SmoothedRTT.Seconds()
+}
+
+func (m *PrometheusMetrics) AuthAttempt(result string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.authAttempts[result]++
+}
+
+func (m *PrometheusMetrics) HandshakeDuration(duration time.Duration) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	seconds := duration.Seconds()
+	for index, bound := range prometheusDurationBuckets {
+		if seconds <= bound {
+			m.handshakeBuckets[index]++
+		}
+	}
+	m.handshakeSum += seconds
+	m.handshakeCount++
+}
+
+func (m *PrometheusMetrics) StreamOpened(network string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.streams[network]++
+}
+
+func (m *PrometheusMetrics) BytesRelayed(network string, uploaded int64, downloaded int64) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.uploaded[network] += uint64(uploaded)
+	m.downloaded[network] += uint64(downloaded)
+}
+
+func (m *PrometheusMetrics) AcceptError() {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.acceptErrors++
+}
+
+func (m *PrometheusMetrics) DialError() {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.dialErrors++
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var buffer bytes.Buffer
+	m.access.Lock()
+	m.writeGauge(&buffer, "active_sessions", "Number of active sessions.", float64(m.activeSessions))
+	m.writeCounterVec(&buffer, "auth_attempts_total", "Authentication attempts by result.", "result", m.authAttempts)
+	m.writeCounterVec(&buffer, "streams_total", "Streams opened by network.", "network", m.streams)
+	m.writeHeader(&buffer, "bytes_total", "Bytes relayed by network and direction.", "counter")
+	for _, network := range sortedKeys(m.uploaded) {
+		m.writeSample(&buffer, "bytes_total", []string{"network", network, "direction", "upload"}, float64(m.uploaded[network]))
+		m.writeSample(&buffer, "bytes_total", []string{"network", network, "direction", "download"}, float64(m.downloaded[network]))
+	}
+	m.writeHeader(&buffer, "handshake_duration_seconds", "Handshake durations.", "histogram")
+	for index, bound := range prometheusDurationBuckets {
+		m.writeSample(&buffer, "handshake_duration_seconds_bucket", []string{"le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(m.handshakeBuckets[index]))
+	}
+	m.writeSample(&buffer, "handshake_duration_seconds_bucket", []string{"le", "+Inf"}, float64(m.handshakeCount))
+	m.writeSample(&buffer, "handshake_duration_seconds_sum", nil, m.handshakeSum)
+	m.writeSample(&buffer, "handshake_duration_seconds_count", nil, float64(m.handshakeCount))
+	m.writeCounter(&buffer, "accept_errors_total", "Errors accepting connections.", float64(m.acceptErrors))
+	m.writeCounter(&buffer, "dial_errors_total", "Errors dialing connections.", float64(m.dialErrors))
+	congestionControls := sortedKeys(m.congestionStatsMap)
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(stats *prometheusCongestionStats) float64
+	}{
+		{"congestion_sessions_total", "Closed sessions by congestion control algorithm.", func(stats *prometheusCongestionStats) float64 { return float64(stats.sessions) }},
+		{"congestion_bytes_sent_total", "Bytes sent by congestion control algorithm.", func(stats *prometheusCongestionStats) float64 { return float64(stats.bytesSent) }},
+		{"congestion_bytes_lost_total", "Bytes lost by congestion control algorithm.", func(stats *prometheusCongestionStats) float64 { return float64(stats.bytesLost) }},
+		{"congestion_packets_sent_total", "Packets sent by congestion control algorithm.", func(stats *prometheusCongestionStats) float64 { return float64(stats.packetsSent) }},
+		{"congestion_packets_lost_total", "Packets lost by congestion control algorithm.", func(stats *prometheusCongestionStats) float64 { return float64(stats.packetsLost) }},
+		{"congestion_smoothed_rtt_seconds_total", "Sum of the final smoothed RTT of closed sessions by congestion control algorithm.", func(stats *prometheusCongestionStats) float64 { return stats.smoothedRTTSum }},
+	} {
+		m.writeHeader(&buffer, metric.name, metric.help, "counter")
+		for _, congestionControl := range congestionControls {
+			m.writeSample(&buffer, metric.name, []string{"algorithm", congestionControl}, metric.value(m.congestionStatsMap[congestionControl]))
+		}
+	}
+	m.access.Unlock()
+	return buffer.WriteTo(w)
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+func (m *PrometheusMetrics) writeHeader(buffer *bytes.Buffer, name string, help string, metricType string) {
+	buffer.WriteString("# HELP " + m.name(name) + " " + help + "\n")
+	buffer.WriteString("# TYPE " + m.name(name) + " " + metricType + "\n")
+}
+
+func (m *PrometheusMetrics) writeSample(buffer *bytes.Buffer, name string, labels []string, value float64) {
+	buffer.WriteString(m.name(name))
+	if len(labels) > 0 {
+		buffer.WriteByte('{')
+		for index := 0; index < len(labels); index += 2 {
+			if index > 0 {
+				buffer.WriteByte(',')
+			}
+			buffer.WriteString(labels[index] + `="` + prometheusLabelEscaper.Replace(labels[index+1]) + `"`)
+		}
+		buffer.WriteByte('}')
+	}
+	buffer.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+func (m *PrometheusMetrics) writeGauge(buffer *bytes.Buffer, name string, help string, value float64) {
+	m.writeHeader(buffer, name, help, "gauge")
+	m.writeSample(buffer, name, nil, value)
+}
+
+func (m *PrometheusMetrics) writeCounter(buffer *bytes.Buffer, name string, help string, value float64) {
+	m.writeHeader(buffer, name, help, "counter")
+	m.writeSample(buffer, name, nil, value)
+}
+
+func (m *PrometheusMetrics) writeCounterVec(buffer *bytes.Buffer, name string, help string, label string, values map[string]uint64) {
+	m.writeHeader(buffer, name, help, "counter")
+	for _, key := range sortedKeys(values) {
+		m.writeSample(buffer, name, []string{label, key}, float64(values[key]))
+	}
+}
+
+func (m *PrometheusMetrics) name(name string) string {
+	if m.namespace == "" {
+		return name
+	}
+	return m.namespace + "_" + name
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -36,17 +36,19 @@ var (
 type udpPacketConn struct {
 	net.Conn
 	readWaitOptions network.ReadWaitOptions
+	// destinationFilter drops packets to disallowed destinations on the server side.
+	destinationFilter func(destination metadata.Socksaddr) bool
 }
 
 func (c *udpPacketConn) FrontHeadroom() int {
-	if clientConn, ok := c.Conn.(*clientConn); ok && !clientConn.requestWritten {
+	if clientConn, ok := c.Conn.(*clientConn); ok && !clientConn.requestWritten.Load() {
 		return 1 + metadata.MaxSocksaddrLength + metadata.MaxSocksaddrLength + 2
 	}
 	return metadata.MaxSocksaddrLength + 2
 }
 
 func (c *udpPacketConn) NeedHandshakeForWrite() bool {
-	if clientConn, ok := c.Conn.(*clientConn); ok && !clientConn.requestWritten {
+	if clientConn, ok := c.Conn.(*clientConn); ok && !clientConn.requestWritten.Load() {
 		return true
 	}
 	return false
@@ -55,17 +57,22 @@ func (c *udpPacketConn) NeedHandshakeForWrite() bool {
 func (c *udpPacketConn) ReadPacket(buffer *buf.Buffer) (destination metadata.Socksaddr, err error) {
 	// The official Juicity server implementation always responses with IPv4-mapped IPv6 address for IPv4, and AddressSerializer.ReadAddrPort has already converted it to the correct one so we don't need to convert it ourselves.
 	// This is not documented in Juicity Specification, and this is a bug of the official Juicity server implementation.
-	destination, err = AddressSerializer.ReadAddrPort(c.Conn)
-	if err != nil {
-		return
-	}
-	var length uint16
-	err = binary.Read(c.Conn, binary.BigEndian, &length)
-	if err != nil {
-		return
+	for {
+		destination, err = AddressSerializer.ReadAddrPort(c.Conn)
+		if err != nil {
+			return
+		}
+		var length uint16
+		err = binary.Read(c.Conn, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+		_, err = buffer.ReadFullFrom(c.Conn, int(length))
+		if err != nil || c.destinationFilter == nil || c.destinationFilter(destination) {
+			return
+		}
+		buffer.Reset()
 	}
-	_, err = buffer.ReadFullFrom(c.Conn, int(length))
-	return
 }
 
 func (c *udpPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
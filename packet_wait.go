@@ -33,20 +33,27 @@ func (c *udpPacketConn) InitializeReadWaiter(options network.ReadWaitOptions) (n
 }
 
 func (c *udpPacketConn) WaitReadPacket() (buffer *buf.Buffer, destination metadata.Socksaddr, err error) {
-	destination, err = metadata.SocksaddrSerializer.ReadAddrPort(c.Conn)
-	if err != nil {
-		return
-	}
-	var length uint16
-	err = binary.Read(c.Conn, binary.BigEndian, &length)
-	if err != nil {
-		return
-	}
-	buffer = c.readWaitOptions.NewPacketBuffer()
-	_, err = buffer.ReadFullFrom(c.Conn, int(length))
-	if err != nil {
+	for {
+		destination, err = metadata.SocksaddrSerializer.ReadAddrPort(c.Conn)
+		if err != nil {
+			return
+		}
+		var length uint16
+		err = binary.Read(c.Conn, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+		buffer = c.readWaitOptions.NewPacketBuffer()
+		_, err = buffer.ReadFullFrom(c.Conn, int(length))
+		if err != nil {
+			buffer.Release()
+			buffer = nil
+			return
+		}
+		if c.destinationFilter == nil || c.destinationFilter(destination) {
+			break
+		}
 		buffer.Release()
-		return
 	}
 	c.readWaitOptions.PostReturn(buffer)
 	return
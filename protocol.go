@@ -50,5 +50,8 @@ func wrapQUICError(err error) error {
 	if err == io.EOF {
 		return io.EOF
 	}
+	if appErr := applicationErrorFromQUIC(err); appErr != nil {
+		return appErr
+	}
 	return qtls.WrapError(err)
 }
@@ -0,0 +1,150 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/sagernet/sing/common/exceptions"
+)
+
+// CircuitState is the state of the reconnect backoff of a Client.
+type CircuitState uint8
+
+const (
+	// CircuitClosed allows connecting, as the last connection attempt succeeded.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails new connections with ErrReconnectBackoff until the backoff delay elapses.
+	CircuitOpen
+	// CircuitHalfOpen allows connecting again after the backoff delay. It is closed once the server responds on a new connection,
+	// or opened again with a longer delay if connecting fails.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitState returns the state of the reconnect backoff. It is always CircuitClosed if ReconnectBackoff is zero.
+func (c *Client) CircuitState() CircuitState {
+	c.stateAccess.Lock()
+	defer c.stateAccess.Unlock()
+	switch {
+	case c.failures == 0:
+		return CircuitClosed
+	case time.Now().Before(c.retryAt):
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+// checkBackoff returns an error wrapping the last failure if connecting is suspended.
+func (c *Client) checkBackoff() error {
+	if c.reconnectBackoff == 0 {
+		return nil
+	}
+	c.stateAccess.Lock()
+	defer c.stateAccess.Unlock()
+	if c.failures == 0 || !time.Now().Before(c.retryAt) {
+		return nil
+	}
+	return exceptions.Cause1(ErrReconnectBackoff, c.lastErr)
+}
+
+// connectFailed suspends connecting for an exponential delay with jitter.
+func (c *Client) connectFailed(err error) {
+	if c.reconnectBackoff == 0 {
+		return
+	}
+	c.stateAccess.Lock()
+	defer c.stateAccess.Unlock()
+	c.failures++
+	delay := c.reconnectBackoff
+	for i := 1; i < c.failures && delay < c.maxReconnectBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, c.maxReconnectBackoff)
+	delay = delay/2 + rand.N(delay/2+1)
+	c.retryAt = time.Now().Add(delay)
+	c.lastErr = err
+}
+
+// connectSucceeded resets the backoff. It is called when the server responds on a connection, since a rejected
+// authentication is only known when the server closes the connection.
+func (c *Client) connectSucceeded() {
+	if c.reconnectBackoff == 0 {
+		return
+	}
+	c.stateAccess.Lock()
+	defer c.stateAccess.Unlock()
+	c.failures = 0
+	c.retryAt = time.Time{}
+	c.lastErr = nil
+}
+
+// connectionOpened and connectionClosed call events after releasing c.stateAccess, so that events may call methods of the Client.
+func (c *Client) connectionOpened() {
+	c.stateAccess.Lock()
+	c.connections++
+	connected := c.connections == 1
+	c.stateAccess.Unlock()
+	if connected && c.events != nil {
+		c.events.Connected()
+	}
+}
+
+func (c *Client) connectionClosed(err error) {
+	authFailed := isAuthError(err)
+	if authFailed {
+		c.connectFailed(err)
+	}
+	c.stateAccess.Lock()
+	c.connections--
+	disconnected := c.connections == 0
+	c.stateAccess.Unlock()
+	if c.events == nil {
+		return
+	}
+	if authFailed {
+		c.events.AuthFailed(err)
+	}
+	if disconnected {
+		c.events.Disconnected(err)
+	}
+}
+
+func isAuthError(err error) bool {
+	for _, authErr := range []error{ErrAuthFailed, ErrUnknownUser, ErrTokenMismatch, ErrUserExpired, ErrAuthThrottled, ErrAuthTimeout} {
+		if errors.Is(err, authErr) {
+			return true
+		}
+	}
+	return false
+}
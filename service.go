@@ -18,14 +18,17 @@ along with this program. If not, see <https://www.gnu.org/licenses/>.
 package juicity
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"io"
 	"net"
+	"net/netip"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sagernet/quic-go"
@@ -38,6 +41,7 @@ import (
 	"github.com/sagernet/sing/common/logger"
 	"github.com/sagernet/sing/common/metadata"
 	"github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/ntp"
 	"github.com/sagernet/sing/common/tls"
 )
 
@@ -47,12 +51,36 @@ type ServiceOptions struct {
 	TLSConfig         tls.ServerConfig
 	CongestionControl string
 	AuthTimeout       time.Duration
+	// MaxCredentials is the number of passwords checked for each authentication, default 4.
+	// Every authentication costs the same regardless of the user, so that valid UUIDs cannot be found by timing.
+	// Unexpired passwords of a user beyond MaxCredentials are ignored.
+	MaxCredentials int
+	// AuthFailureThreshold is the number of authentication failures from a source IPv4 address or IPv6 /64 prefix before it is banned.
+	// The ban window starts at AuthBanDuration (default 1 minute) and doubles on each ban up to AuthMaxBanDuration (default 24 hours).
+	// Connections from banned IPs are closed as soon as they are accepted. Zero disables throttling.
+	AuthFailureThreshold int
+	AuthBanDuration      time.Duration
+	AuthMaxBanDuration   time.Duration
+	// AllowedSources and DeniedSources filter clients by source IP. Denied sources take precedence,
+	// and if AllowedSources is not empty, other sources are denied.
+	// Packets from disallowed sources are dropped before the QUIC handshake, including after the lists are replaced with UpdateSourceFilter.
+	AllowedSources []netip.Prefix
+	DeniedSources  []netip.Prefix
+	// DestinationPolicy is checked for every stream before calling Handler, and for every UDP packet.
+	// Denied streams are reset with ErrorCodeDestinationDenied, denied UDP packets are dropped.
+	DestinationPolicy *DestinationPolicy
 	// UDPTimeout  time.Duration todo?
+	// Handler handles streams of users for whom the resolver set with UpdateHandlerResolver picks no handler.
 	Handler ServiceHandler
+	Events  ServiceEvents
+	Metrics ServiceMetrics
 
 	allowAllCongestionControl bool // do not export
 }
 
+// ServiceHandler handles streams of a Service.
+// If the destination of a stream cannot be reached, handlers should report the error with network.CloseOnHandshakeFailure
+// or network.ReportHandshakeFailure, so that the stream is reset with a code telling the client why, see ErrorCode.
 type ServiceHandler interface {
 	network.TCPConnectionHandlerEx
 	network.UDPConnectionHandlerEx
@@ -63,13 +91,26 @@ type Service[U comparable] struct {
 	logger            logger.Logger
 	tlsConfig         tls.ServerConfig
 	quicConfig        *quic.Config
-	userMap           map[[16]byte]U
-	passwordMap       map[U]string
+	usersAccess       sync.Mutex
+	users             atomic.Pointer[serviceUsers[U]]
+	timeFunc          func() time.Time
 	congestionControl string
 	authTimeout       time.Duration
-	handler           ServiceHandler
+	authThrottle      *authThrottle
+	dummyPassword     []byte
+	maxCredentials    int
+	sourceFilter      sourceFilter
 
-	quicListener io.Closer
+	destinationPolicies atomic.Pointer[destinationPolicies[U]]
+	handler             ServiceHandler
+	handlerResolver     atomic.Pointer[func(user U) ServiceHandler]
+	events              ServiceEvents
+	metrics             ServiceMetrics
+
+	quicListener  io.Closer
+	lastSessionID atomic.Uint64
+	sessionAccess sync.Mutex
+	sessions      map[*serverSession[U]]struct{}
 }
 
 func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
@@ -77,12 +118,17 @@ func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
 		// Official Juicity server uses 10 seconds
 		options.AuthTimeout = 10 * time.Second
 	}
+	if options.MaxCredentials < 0 {
+		return nil, exceptions.New("invalid max credentials: ", options.MaxCredentials)
+	} else if options.MaxCredentials == 0 {
+		options.MaxCredentials = 4
+	}
 	quicConfig := &quic.Config{
 		DisablePathMTUDiscovery: !(runtime.GOOS == "windows" || runtime.GOOS == "linux" || runtime.GOOS == "android" || runtime.GOOS == "darwin"),
 		EnableDatagrams:         true,
 		MaxIncomingStreams:      1 << 60,
 		MaxIncomingUniStreams:   1 << 60,
-		DisablePathManager:      true,
+		// The path manager validates new client addresses before switching to them, so clients can migrate with Client.Rebind.
 	}
 	switch options.CongestionControl {
 	case "":
@@ -90,33 +136,201 @@ func NewService[U comparable](options ServiceOptions) (*Service[U], error) {
 	case "cubic", "new_reno", "bbr", "bbr2":
 	default:
 		if !options.allowAllCongestionControl {
-			return nil, exceptions.New("unknown congestion control algorithm: ", options.CongestionControl)
+			return nil, exceptions.Extend(ErrUnknownCongestionControl, options.CongestionControl)
 		}
 	}
-	return &Service[U]{
+	var throttle *authThrottle
+	if options.AuthFailureThreshold > 0 {
+		throttle = newAuthThrottle(options.AuthFailureThreshold, options.AuthBanDuration, options.AuthMaxBanDuration)
+	}
+	dummyPassword := make([]byte, 16)
+	_, err := rand.Read(dummyPassword)
+	if err != nil {
+		return nil, err
+	}
+	timeFunc := ntp.TimeFuncFromContext(options.Context)
+	if timeFunc == nil {
+		timeFunc = time.Now
+	}
+	service := &Service[U]{
 		ctx:               options.Context,
 		logger:            options.Logger,
 		tlsConfig:         options.TLSConfig, // servers need to set ALPN `h3` themselves
 		quicConfig:        quicConfig,
-		userMap:           make(map[[16]byte]U),
+		timeFunc:          timeFunc,
 		congestionControl: options.CongestionControl,
 		authTimeout:       options.AuthTimeout,
+		authThrottle:      throttle,
+		dummyPassword:     dummyPassword,
+		maxCredentials:    options.MaxCredentials,
 		handler:           options.Handler,
-	}, nil
+		events:            options.Events,
+		metrics:           options.Metrics,
+		sessions:          make(map[*serverSession[U]]struct{}),
+	}
+	service.users.Store(&serviceUsers[U]{})
+	service.destinationPolicies.Store(&destinationPolicies[U]{global: options.DestinationPolicy})
+	service.sourceFilter.update(options.AllowedSources, options.DeniedSources)
+	return service, nil
+}
+
+// serviceUsers is replaced as a whole, so that authentication never sees a partial update.
+type serviceUsers[U comparable] struct {
+	userMap       map[[16]byte]U
+	credentialMap map[U][]Credential
+	validityMap   map[U]UserValidity
+}
+
+// Credential is a password of a user. A zero ExpiresAt never expires.
+type Credential struct {
+	Password  string    `json:"password"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// User is a user with its credentials and validity period.
+type User[U comparable] struct {
+	User        U
+	UUID        [16]byte
+	Credentials []Credential
+	Validity    UserValidity
 }
 
 func (s *Service[U]) UpdateUsers(userList []U, uuidList [][16]byte, passwordList []string) {
+	credentialList := make([][]Credential, len(passwordList))
+	for index, password := range passwordList {
+		credentialList[index] = []Credential{{Password: password}}
+	}
+	s.UpdateUserCredentials(userList, uuidList, credentialList)
+}
+
+// UpdateUserCredentials is like UpdateUsers, but each user may have several passwords, so that passwords can be rotated with a grace period.
+// A client authenticates if its token matches any password of the user which has not expired, see ServiceOptions.MaxCredentials.
+func (s *Service[U]) UpdateUserCredentials(userList []U, uuidList [][16]byte, credentialList [][]Credential) {
 	userMap := make(map[[16]byte]U)
-	passwordMap := make(map[U]string)
+	credentialMap := make(map[U][]Credential)
 	for index := range userList {
 		userMap[uuidList[index]] = userList[index]
-		passwordMap[userList[index]] = passwordList[index]
+		credentialMap[userList[index]] = credentialList[index]
 	}
-	s.userMap = userMap
-	s.passwordMap = passwordMap
+	s.usersAccess.Lock()
+	defer s.usersAccess.Unlock()
+	s.users.Store(&serviceUsers[U]{
+		userMap:       userMap,
+		credentialMap: credentialMap,
+		validityMap:   s.users.Load().validityMap,
+	})
+}
+
+// UserValidity is the period in which a user may authenticate. Zero NotBefore or NotAfter is unbounded.
+type UserValidity struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+func (v UserValidity) contains(now time.Time) bool {
+	return (v.NotBefore.IsZero() || !now.Before(v.NotBefore)) && (v.NotAfter.IsZero() || now.Before(v.NotAfter))
+}
+
+// UpdateUserValidity replaces the validity periods of users. Users without a validity period are always valid.
+// Authentication outside the period fails with ErrUserExpired, and open sessions are closed when the period ends.
+// Time is taken from the NTP service in the context if available.
+func (s *Service[U]) UpdateUserValidity(validityMap map[U]UserValidity) {
+	s.usersAccess.Lock()
+	users := *s.users.Load()
+	users.validityMap = validityMap
+	s.users.Store(&users)
+	s.usersAccess.Unlock()
+	for _, session := range s.sessionList() {
+		if session.authenticated() {
+			session.scheduleExpiry()
+		}
+	}
+}
+
+// ReplaceUsers replaces all users, their credentials and validity periods atomically.
+// Sessions of users which no longer exist are closed, other sessions are not affected.
+func (s *Service[U]) ReplaceUsers(userList []User[U]) error {
+	userMap := make(map[[16]byte]U)
+	credentialMap := make(map[U][]Credential)
+	validityMap := make(map[U]UserValidity)
+	for _, user := range userList {
+		if _, loaded := userMap[user.UUID]; loaded {
+			return exceptions.New("duplicate uuid ", uuidToString(user.UUID))
+		}
+		if _, loaded := credentialMap[user.User]; loaded {
+			return exceptions.New("duplicate user ", user.User)
+		}
+		userMap[user.UUID] = user.User
+		credentialMap[user.User] = user.Credentials
+		if user.Validity != (UserValidity{}) {
+			validityMap[user.User] = user.Validity
+		}
+	}
+	s.usersAccess.Lock()
+	s.users.Store(&serviceUsers[U]{
+		userMap:       userMap,
+		credentialMap: credentialMap,
+		validityMap:   validityMap,
+	})
+	s.usersAccess.Unlock()
+	for _, session := range s.sessionList() {
+		if !session.authenticated() {
+			continue
+		}
+		if _, loaded := credentialMap[session.authUser]; !loaded {
+			go session.closeWithError(authFailedError(exceptions.Cause(ErrUnknownUser, "user removed")))
+			continue
+		}
+		session.scheduleExpiry()
+	}
+	return nil
+}
+
+// UpdateSourceFilter replaces the source IP allow and deny lists without restarting the listener.
+// Established sessions are not affected.
+func (s *Service[U]) UpdateSourceFilter(allow []netip.Prefix, deny []netip.Prefix) {
+	s.sourceFilter.update(allow, deny)
+}
+
+// UpdateDestinationPolicy replaces the global destination policy and the per-user destination policies.
+// A destination must be allowed by both the global policy and the policy of the user, if any.
+func (s *Service[U]) UpdateDestinationPolicy(policy *DestinationPolicy, userPolicies map[U]*DestinationPolicy) {
+	s.destinationPolicies.Store(&destinationPolicies[U]{
+		global: policy,
+		users:  userPolicies,
+	})
+}
+
+// UpdateHandlerResolver sets a function picking the handler of streams from an authenticated user, e.g. by the group of the user.
+// If resolver is nil or returns nil, streams go to ServiceOptions.Handler.
+func (s *Service[U]) UpdateHandlerResolver(resolver func(user U) ServiceHandler) {
+	if resolver == nil {
+		s.handlerResolver.Store(nil)
+		return
+	}
+	s.handlerResolver.Store(&resolver)
+}
+
+// AuthBans returns the sources with recent authentication failures, or nil if throttling is disabled.
+func (s *Service[U]) AuthBans() []AuthBan {
+	if s.authThrottle == nil {
+		return nil
+	}
+	return s.authThrottle.list()
+}
+
+// ClearAuthBans forgets the authentication failures of addrs, or of all sources if addrs is empty.
+// An IPv6 address clears its /64 prefix.
+func (s *Service[U]) ClearAuthBans(addrs ...netip.Addr) {
+	if s.authThrottle == nil {
+		return
+	}
+	s.authThrottle.clear(addrs)
 }
 
 func (s *Service[U]) Start(conn net.PacketConn) error {
+	// The filter is always installed, so that lists set later with UpdateSourceFilter also drop packets before the QUIC handshake.
+	conn = newFilterPacketConn(conn, &s.sourceFilter)
 	listener, err := qtls.Listen(conn, s.tlsConfig, s.quicConfig)
 	if err != nil {
 		return err
@@ -129,10 +343,24 @@ func (s *Service[U]) Start(conn net.PacketConn) error {
 				if exceptions.IsClosedOrCanceled(hErr) || errors.Is(hErr, quic.ErrServerClosed) {
 					s.logger.Debug(exceptions.Cause(hErr, "listener closed"))
 				} else {
+					if s.metrics != nil {
+						s.metrics.AcceptError()
+					}
 					s.logger.Error(exceptions.Cause(hErr, "listener closed"))
 				}
 				return
 			}
+			source := metadata.SocksaddrFromNet(connection.RemoteAddr()).Unwrap()
+			if !s.sourceFilter.allowed(source.Addr) {
+				s.logger.Debug("reject connection from disallowed source ", source.Addr)
+				_ = connection.CloseWithError(0, "")
+				continue
+			}
+			if s.authThrottle != nil && s.authThrottle.banned(source.Addr) {
+				s.logger.Debug("reject connection from banned source ", source.Addr)
+				_ = connection.CloseWithError(quic.ApplicationErrorCode(ErrorCodeAuthThrottled), "")
+				continue
+			}
 			go s.handleConnection(connection)
 		}
 	}()
@@ -140,44 +368,84 @@ func (s *Service[U]) Start(conn net.PacketConn) error {
 }
 
 func (s *Service[U]) Close() error {
-	return common.Close(
+	err := common.Close(
 		s.quicListener,
 	)
+	for _, session := range s.sessionList() {
+		session.closeWithError(exceptions.Cause1(ErrServerShutdown, net.ErrClosed))
+	}
+	return err
+}
+
+func (s *Service[U]) sessionList() []*serverSession[U] {
+	s.sessionAccess.Lock()
+	defer s.sessionAccess.Unlock()
+	sessions := make([]*serverSession[U], 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
 }
 
 func (s *Service[U]) handleConnection(connection *quic.Conn) {
 	setCongestion(s.ctx, connection, s.congestionControl)
+	acceptedAt := time.Now()
+	info := newSessionInfo(s.lastSessionID.Add(1), connection, acceptedAt)
+	// The session context is canceled when the session is closed, so that handlers of its streams stop.
+	ctx, cancel := common.ContextWithCancelCause(ContextWithSessionInfo(s.ctx, info))
 	session := &serverSession[U]{
-		Service:  s,
-		ctx:      s.ctx,
-		quicConn: connection,
-		connDone: make(chan struct{}),
-		authDone: make(chan struct{}),
+		Service:    s,
+		ctx:        ctx,
+		cancel:     cancel,
+		quicConn:   connection,
+		info:       info,
+		source:     info.RemoteAddr,
+		acceptedAt: acceptedAt,
+		connDone:   make(chan struct{}),
+		authDone:   make(chan struct{}),
+	}
+	s.sessionAccess.Lock()
+	s.sessions[session] = struct{}{}
+	s.sessionAccess.Unlock()
+	if s.metrics != nil {
+		s.metrics.SessionOpened()
+	}
+	if s.events != nil {
+		s.events.ConnectionAccepted(session.ctx, session.source)
 	}
 	session.handle()
 }
 
 type serverSession[U comparable] struct {
 	*Service[U]
-	ctx        context.Context
-	quicConn   *quic.Conn
-	connAccess sync.Mutex
-	connDone   chan struct{}
-	connErr    error
-	authDone   chan struct{}
-	authUser   U
+	ctx            context.Context
+	cancel         common.ContextCancelCauseFunc
+	quicConn       *quic.Conn
+	info           *SessionInfo
+	source         metadata.Socksaddr
+	acceptedAt     time.Time
+	connAccess     sync.Mutex
+	connDone       chan struct{}
+	connErr        error
+	authDone       chan struct{}
+	authenticating atomic.Bool
+	authUser       U
+	authCtx        context.Context
+
+	expiryAccess sync.Mutex
+	expiryTimer  *time.Timer
 }
 
 func (s *serverSession[U]) handle() {
-	if s.ctx.Done() != nil {
-		go func() {
-			select {
-			case <-s.ctx.Done():
-				s.closeWithError(s.ctx.Err())
-			case <-s.connDone:
-			}
-		}()
-	}
+	go func() {
+		select {
+		case <-s.Service.ctx.Done():
+			s.closeWithError(exceptions.Cause1(ErrServerShutdown, s.Service.ctx.Err()))
+		case <-s.quicConn.Context().Done():
+			s.closeWithError(wrapQUICError(context.Cause(s.quicConn.Context())))
+		case <-s.connDone:
+		}
+	}()
 	go s.loopUniStreams()
 	go s.loopStreams()
 	go s.handleAuthTimeout()
@@ -192,6 +460,9 @@ func (s *serverSession[U]) loopUniStreams() {
 		go func() {
 			err = s.handleUniStream(uniStream)
 			if err != nil {
+				if !s.authenticated() {
+					s.reportAuthFailed(err)
+				}
 				s.closeWithError(exceptions.Cause(err, "handle uni stream"))
 			}
 		}()
@@ -208,15 +479,14 @@ func (s *serverSession[U]) handleUniStream(stream *quic.ReceiveStream) error {
 	}
 	version := buffer.Byte(0)
 	if version != Version {
-		return exceptions.New("unknown version ", buffer.Byte(0))
+		return &VersionError{Version: version}
 	}
 	command := buffer.Byte(1)
 	switch command {
 	case CommandAuthenticate:
-		select {
-		case <-s.authDone:
-			return exceptions.New("authentication: multiple authentication requests")
-		default:
+		// Concurrent authentication streams must not both close authDone. A failed attempt closes the session, so the claim is never released.
+		if !s.authenticating.CompareAndSwap(false, true) {
+			return exceptions.Cause(ErrMultipleAuthentication, "authentication")
 		}
 		if buffer.Len() < AuthenticateLen {
 			_, err = buffer.ReadFullFrom(stream, AuthenticateLen-buffer.Len())
@@ -226,23 +496,54 @@ func (s *serverSession[U]) handleUniStream(stream *quic.ReceiveStream) error {
 		}
 		var userUUID [16]byte
 		copy(userUUID[:], buffer.Range(2, 2+16))
-		user, loaded := s.userMap[userUUID]
-		if !loaded {
-			return exceptions.New("authentication: unknown user ", uuidToString(userUUID))
+		// Unknown users and token mismatches must be indistinguishable in both timing and response,
+		// so maxCredentials tokens are always exported and compared, padded with a dummy password.
+		users := s.users.Load()
+		user, loaded := users.userMap[userUUID]
+		passwords := make([][]byte, 0, s.maxCredentials)
+		now := s.timeFunc()
+		if loaded {
+			for _, credential := range users.credentialMap[user] {
+				if len(passwords) == s.maxCredentials {
+					break
+				}
+				if credential.ExpiresAt.IsZero() || now.Before(credential.ExpiresAt) {
+					passwords = append(passwords, []byte(credential.Password))
+				}
+			}
+		}
+		for len(passwords) < s.maxCredentials {
+			passwords = append(passwords, s.dummyPassword)
 		}
 		handshakeState := s.quicConn.ConnectionState()
-		token, err := handshakeState.TLS.ExportKeyingMaterial(string(userUUID[:]), []byte(s.passwordMap[user]), 32)
-		if err != nil {
-			return exceptions.Cause(err, "authentication: export keying material")
+		var tokenMatched int
+		for _, password := range passwords {
+			token, err := handshakeState.TLS.ExportKeyingMaterial(string(userUUID[:]), password, 32)
+			if err != nil {
+				return exceptions.Cause(err, "authentication: export keying material")
+			}
+			tokenMatched |= subtle.ConstantTimeCompare(token, buffer.Range(2+16, AuthenticateLen))
+		}
+		if !loaded {
+			return authFailedError(exceptions.Extend(ErrUnknownUser, uuidToString(userUUID)))
 		}
-		if !bytes.Equal(token, buffer.Range(2+16, AuthenticateLen)) {
-			return exceptions.New("authentication: token mismatch")
+		if tokenMatched != 1 {
+			return authFailedError(ErrTokenMismatch)
+		}
+		if validity, loaded := users.validityMap[user]; loaded && !validity.contains(now) {
+			return exceptions.Cause(ErrUserExpired, "authentication")
 		}
 		s.authUser = user
+		// The info attached to s.ctx may be retained by ServiceEvents.ConnectionAccepted, so it is copied instead of modified.
+		authInfo := *s.info
+		authInfo.UUID = userUUID
+		s.authCtx = auth.ContextWithUser(ContextWithSessionInfo(s.ctx, &authInfo), user)
 		close(s.authDone)
+		s.reportAuthSucceeded()
+		s.scheduleExpiry()
 		return nil
 	default:
-		return exceptions.New("unknown command ", command)
+		return exceptions.Extend(ErrUnknownCommand, command)
 	}
 }
 
@@ -251,10 +552,82 @@ func (s *serverSession[U]) handleAuthTimeout() {
 	case <-s.connDone:
 	case <-s.authDone:
 	case <-time.After(s.authTimeout):
-		s.closeWithError(exceptions.New("authentication timeout"))
+		s.reportAuthFailed(ErrAuthTimeout)
+		s.closeWithError(ErrAuthTimeout)
+	}
+}
+
+// scheduleExpiry closes the session when the validity period of the user ends.
+func (s *serverSession[U]) scheduleExpiry() {
+	s.expiryAccess.Lock()
+	defer s.expiryAccess.Unlock()
+	select {
+	case <-s.connDone:
+		return
+	default:
+	}
+	if s.expiryTimer != nil {
+		s.expiryTimer.Stop()
+		s.expiryTimer = nil
+	}
+	validity, loaded := s.users.Load().validityMap[s.authUser]
+	if !loaded {
+		return
+	}
+	now := s.timeFunc()
+	if !validity.contains(now) {
+		go s.closeWithError(ErrUserExpired)
+		return
+	}
+	if !validity.NotAfter.IsZero() {
+		s.expiryTimer = time.AfterFunc(validity.NotAfter.Sub(now), func() {
+			s.closeWithError(ErrUserExpired)
+		})
 	}
 }
 
+func (s *serverSession[U]) reportAuthSucceeded() {
+	if s.authThrottle != nil {
+		s.authThrottle.recordSuccess(s.source.Addr)
+	}
+	if s.metrics != nil {
+		s.metrics.AuthAttempt(AuthResult(nil))
+		s.metrics.HandshakeDuration(time.Since(s.acceptedAt))
+	}
+	if s.events != nil {
+		s.events.AuthSucceeded(s.userContext(), s.source)
+	}
+}
+
+func (s *serverSession[U]) reportAuthFailed(err error) {
+	if s.authThrottle != nil {
+		s.authThrottle.recordFailure(s.source.Addr)
+	}
+	if s.metrics != nil {
+		s.metrics.AuthAttempt(AuthResult(err))
+	}
+	if s.events != nil {
+		s.events.AuthFailed(s.ctx, s.source, err)
+	}
+}
+
+func (s *serverSession[U]) authenticated() bool {
+	select {
+	case <-s.authDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// userContext returns the session context with the user attached once authenticated.
+func (s *serverSession[U]) userContext() context.Context {
+	if !s.authenticated() {
+		return s.ctx
+	}
+	return s.authCtx
+}
+
 func (s *serverSession[U]) loopStreams() {
 	for {
 		stream, err := s.quicConn.AcceptStream(s.ctx)
@@ -264,8 +637,13 @@ func (s *serverSession[U]) loopStreams() {
 		go func() {
 			err = s.handleStream(stream)
 			if err != nil {
-				stream.CancelRead(0)
-				stream.Close()
+				code := errorCodeFromError(err)
+				stream.CancelRead(quic.StreamErrorCode(code))
+				if code != ErrorCodeNone {
+					stream.CancelWrite(quic.StreamErrorCode(code))
+				} else {
+					stream.Close()
+				}
 				s.logger.Error(exceptions.Cause(err, "handle stream request"))
 			}
 		}()
@@ -283,7 +661,7 @@ func (s *serverSession[U]) handleStream(stream *quic.Stream) error {
 	}
 	network, _ := buffer.ReadByte()
 	if network != NetworkTCP && network != NetworkUDP {
-		return exceptions.New("unsupported stream network")
+		return exceptions.Extend(ErrUnsupportedNetwork, network)
 	}
 	destination, err := AddressSerializer.ReadAddrPort(io.MultiReader(buffer, stream))
 	if err != nil {
@@ -294,22 +672,71 @@ func (s *serverSession[U]) handleStream(stream *quic.Stream) error {
 		return s.connErr
 	case <-s.authDone:
 	}
-	var conn net.Conn = &serverConn{
+	if !s.destinationAllowed(destination) {
+		return exceptions.Extend(ErrDestinationDenied, destination)
+	}
+	ctx := s.userContext()
+	rawConn := &serverConn{
 		Stream:      stream,
+		source:      s.source,
 		destination: destination,
 	}
+	var conn net.Conn = rawConn
 	if !buffer.IsEmpty() {
+		rawConn.uploaded.Add(int64(buffer.Len()))
 		conn = bufio.NewCachedConn(conn, buffer.ToOwned())
 	}
+	// The stream context is canceled when the stream or the session is closed.
+	streamCtx, cancel := common.ContextWithCancelCause(contextWithDestinationFilter(ctx, s.destinationAddressAllowed))
+	rawConn.cancel = cancel
+	if s.events != nil || s.metrics != nil {
+		streamNetwork := networkName(network)
+		if s.metrics != nil {
+			s.metrics.StreamOpened(streamNetwork)
+		}
+		if s.events != nil {
+			s.events.StreamOpened(ctx, streamNetwork, s.source, destination)
+		}
+		startedAt := time.Now()
+		rawConn.onClose = func(error) {
+			uploaded, downloaded := rawConn.uploaded.Load(), rawConn.downloaded.Load()
+			if s.metrics != nil {
+				s.metrics.BytesRelayed(streamNetwork, uploaded, downloaded)
+			}
+			if s.events != nil {
+				s.events.StreamClosed(ctx, streamNetwork, s.source, destination, uploaded, downloaded, time.Since(startedAt))
+			}
+		}
+	}
 	switch network {
 	case NetworkTCP:
-		s.handler.NewConnectionEx(auth.ContextWithUser(s.ctx, s.authUser), conn, metadata.SocksaddrFromNet(s.quicConn.RemoteAddr()).Unwrap(), destination, nil)
+		s.userHandler().NewConnectionEx(streamCtx, conn, s.source, destination, rawConn.reportClose)
 	case NetworkUDP:
-		s.handler.NewPacketConnectionEx(auth.ContextWithUser(s.ctx, s.authUser), &udpPacketConn{Conn: conn}, metadata.SocksaddrFromNet(s.quicConn.RemoteAddr()).Unwrap(), destination, nil)
+		s.userHandler().NewPacketConnectionEx(streamCtx, &udpPacketConn{Conn: conn, destinationFilter: s.destinationAllowed}, s.source, destination, rawConn.reportClose)
 	}
 	return nil
 }
 
+func (s *serverSession[U]) userHandler() ServiceHandler {
+	if resolver := s.handlerResolver.Load(); resolver != nil {
+		handler := (*resolver)(s.authUser)
+		if handler != nil {
+			return handler
+		}
+	}
+	return s.handler
+}
+
+func (s *serverSession[U]) destinationAllowed(destination metadata.Socksaddr) bool {
+	policies := s.destinationPolicies.Load()
+	return policies.global.allowed(destination) && policies.users[s.authUser].allowed(destination)
+}
+
+func (s *serverSession[U]) destinationAddressAllowed(address metadata.Socksaddr) bool {
+	policies := s.destinationPolicies.Load()
+	return policies.global.addressAllowed(address) && policies.users[s.authUser].addressAllowed(address)
+}
+
 func (s *serverSession[U]) closeWithError(err error) {
 	s.connAccess.Lock()
 	defer s.connAccess.Unlock()
@@ -320,40 +747,115 @@ func (s *serverSession[U]) closeWithError(err error) {
 		s.connErr = err
 		close(s.connDone)
 	}
+	s.cancel(err)
+	s.sessionAccess.Lock()
+	delete(s.sessions, s)
+	s.sessionAccess.Unlock()
+	s.expiryAccess.Lock()
+	if s.expiryTimer != nil {
+		s.expiryTimer.Stop()
+	}
+	s.expiryAccess.Unlock()
+	if s.metrics != nil {
+		s.metrics.SessionClosed(s.congestionControl, s.quicConn.ConnectionStats())
+	}
+	if s.events != nil {
+		s.events.SessionClosed(s.userContext(), s.source, err)
+	}
 	if exceptions.IsClosedOrCanceled(err) {
 		s.logger.Debug(exceptions.Cause(err, "connection failed"))
 	} else {
 		s.logger.Error(exceptions.Cause(err, "connection failed"))
 	}
-	_ = s.quicConn.CloseWithError(0, "")
+	_ = s.quicConn.CloseWithError(quic.ApplicationErrorCode(errorCodeFromError(err)), "")
 }
 
+var (
+	_ network.HandshakeFailure = (*serverConn)(nil)
+	_ network.ReadCloser       = (*serverConn)(nil)
+	_ network.WriteCloser      = (*serverConn)(nil)
+)
+
 type serverConn struct {
 	*quic.Stream
+	source      metadata.Socksaddr
 	destination metadata.Socksaddr
+	uploaded    atomic.Int64
+	downloaded  atomic.Int64
+	cancel      common.ContextCancelCauseFunc
+	onClose     func(error)
+	closeOnce   sync.Once
 }
 
 func (c *serverConn) Read(p []byte) (int, error) {
 	n, err := c.Stream.Read(p)
+	c.uploaded.Add(int64(n))
 	return n, wrapQUICError(err)
 }
 
 func (c *serverConn) Write(p []byte) (int, error) {
 	n, err := c.Stream.Write(p)
+	c.downloaded.Add(int64(n))
 	return n, wrapQUICError(err)
 }
 
+// reportClose cancels the stream context and calls onClose once, either from the handler or from Close.
+func (c *serverConn) reportClose(err error) {
+	c.closeOnce.Do(func() {
+		if c.cancel != nil {
+			c.cancel(net.ErrClosed)
+		}
+		if c.onClose != nil {
+			c.onClose(err)
+		}
+	})
+}
+
+// HandshakeFailure resets the stream with the code of err, e.g. ErrorCodeConnectionRefused for a refused dial.
+func (c *serverConn) HandshakeFailure(err error) error {
+	code := quic.StreamErrorCode(streamErrorCodeFromError(err))
+	c.Stream.CancelRead(code)
+	c.Stream.CancelWrite(code)
+	return nil
+}
+
+// LocalAddr returns the destination requested by the client, as other sing inbounds do.
 func (c *serverConn) LocalAddr() net.Addr {
 	return c.destination
 }
 
+// RemoteAddr returns the address of the client.
 func (c *serverConn) RemoteAddr() net.Addr {
-	return metadata.Socksaddr{}
+	return c.source
 }
 
 func (c *serverConn) Close() error {
 	c.Stream.CancelRead(0)
-	return c.Stream.Close()
+	err := c.Stream.Close()
+	c.reportClose(nil)
+	return err
+}
+
+// CloseWrite closes the send side of the stream, so that the client reads EOF while it can still write.
+func (c *serverConn) CloseWrite() error {
+	return wrapQUICError(c.Stream.Close())
+}
+
+// CloseRead stops reading from the client, while the stream can still be written.
+func (c *serverConn) CloseRead() error {
+	c.Stream.CancelRead(0)
+	return nil
+}
+
+func networkName(networkType byte) string {
+	switch networkType {
+	case NetworkTCP:
+		return network.NetworkTCP
+	case NetworkUDP:
+		return network.NetworkUDP
+	default:
+		return ""
+	}
 }
 
 func uuidToString(uuid [16]byte) string {
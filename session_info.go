@@ -0,0 +1,73 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"context"
+	"time"
+
+	"github.com/sagernet/quic-go"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// SessionInfo describes the QUIC session of a stream. It is attached to the contexts passed to ServiceHandler and ServiceEvents.
+type SessionInfo struct {
+	// ID is unique among the sessions of a Service.
+	ID uint64
+	// UUID is the UUID of the user, zero in contexts created before authentication.
+	UUID       [16]byte
+	LocalAddr  metadata.Socksaddr
+	RemoteAddr metadata.Socksaddr
+	ServerName string
+	ALPN       string
+	TLSVersion uint16
+	StartedAt  time.Time
+
+	quicConn *quic.Conn
+}
+
+// RTT returns the current smoothed RTT of the session.
+func (i *SessionInfo) RTT() time.Duration {
+	return i.quicConn.ConnectionStats().SmoothedRTT
+}
+
+type sessionInfoKey struct{}
+
+func ContextWithSessionInfo(ctx context.Context, info *SessionInfo) context.Context {
+	return context.WithValue(ctx, sessionInfoKey{}, info)
+}
+
+// SessionInfoFromContext returns the session of a stream passed to ServiceHandler, or nil.
+func SessionInfoFromContext(ctx context.Context) *SessionInfo {
+	info, _ := ctx.Value(sessionInfoKey{}).(*SessionInfo)
+	return info
+}
+
+func newSessionInfo(id uint64, quicConn *quic.Conn, startedAt time.Time) *SessionInfo {
+	tlsState := quicConn.ConnectionState().TLS
+	return &SessionInfo{
+		ID:         id,
+		LocalAddr:  metadata.SocksaddrFromNet(quicConn.LocalAddr()).Unwrap(),
+		RemoteAddr: metadata.SocksaddrFromNet(quicConn.RemoteAddr()).Unwrap(),
+		ServerName: tlsState.ServerName,
+		ALPN:       tlsState.NegotiatedProtocol,
+		TLSVersion: tlsState.Version,
+		StartedAt:  startedAt,
+		quicConn:   quicConn,
+	}
+}
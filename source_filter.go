@@ -0,0 +1,173 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sagernet/sing/common/metadata"
+	"golang.org/x/net/ipv4"
+)
+
+type sourceFilter struct {
+	rules atomic.Pointer[sourceFilterRules]
+}
+
+type sourceFilterRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func (f *sourceFilter) update(allow []netip.Prefix, deny []netip.Prefix) {
+	if len(allow) == 0 && len(deny) == 0 {
+		f.rules.Store(nil)
+		return
+	}
+	f.rules.Store(&sourceFilterRules{
+		allow: slices.Clone(allow),
+		deny:  slices.Clone(deny),
+	})
+}
+
+// allowed reports whether addr is not denied, and is allowed if the allow list is not empty.
+func (f *sourceFilter) allowed(addr netip.Addr) bool {
+	rules := f.rules.Load()
+	if rules == nil {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range rules.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, prefix := range rules.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterPacketConn silently drops packets from disallowed sources, so they never reach the QUIC handshake.
+type filterPacketConn struct {
+	net.PacketConn
+	filter *sourceFilter
+}
+
+func newFilterPacketConn(conn net.PacketConn, filter *sourceFilter) net.PacketConn {
+	if udpConn, isUDPConn := conn.(*net.UDPConn); isUDPConn {
+		return &filterUDPConn{
+			filterPacketConn: filterPacketConn{PacketConn: conn, filter: filter},
+			udpConn:          udpConn,
+			batchConn:        ipv4.NewPacketConn(udpConn),
+		}
+	}
+	return &filterPacketConn{PacketConn: conn, filter: filter}
+}
+
+func (c *filterPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || c.filter.allowed(metadata.SocksaddrFromNet(addr).Addr) {
+			return
+		}
+	}
+}
+
+func (c *filterPacketConn) Upstream() any {
+	return c.PacketConn
+}
+
+// filterUDPConn is filterPacketConn for *net.UDPConn. It keeps the methods quic-go uses to set the DF bit
+// and to read and write with OOB data, including batch reads, so that the transport is not degraded by filtering.
+type filterUDPConn struct {
+	filterPacketConn
+	udpConn   *net.UDPConn
+	batchConn *ipv4.PacketConn
+}
+
+func (c *filterUDPConn) SyscallConn() (syscall.RawConn, error) {
+	return c.udpConn.SyscallConn()
+}
+
+func (c *filterUDPConn) SetReadBuffer(bytes int) error {
+	return c.udpConn.SetReadBuffer(bytes)
+}
+
+func (c *filterUDPConn) SetWriteBuffer(bytes int) error {
+	return c.udpConn.SetWriteBuffer(bytes)
+}
+
+func (c *filterUDPConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	for {
+		n, oobn, flags, addr, err = c.udpConn.ReadMsgUDP(b, oob)
+		if err != nil || c.filter.allowed(addr.AddrPort().Addr()) {
+			return
+		}
+	}
+}
+
+func (c *filterUDPConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	return c.udpConn.WriteMsgUDP(b, oob, addr)
+}
+
+// ReadBatch moves allowed messages to the front of messages. Messages are copied instead of swapped,
+// as the caller may keep references to the buffers of each message.
+func (c *filterUDPConn) ReadBatch(messages []ipv4.Message, flags int) (int, error) {
+	for {
+		n, err := c.batchConn.ReadBatch(messages, flags)
+		if err != nil {
+			return n, err
+		}
+		var allowed int
+		for index := range messages[:n] {
+			message := &messages[index]
+			if !c.filter.allowed(metadata.SocksaddrFromNet(message.Addr).Addr) {
+				continue
+			}
+			if allowed != index {
+				copyMessage(&messages[allowed], message)
+			}
+			allowed++
+		}
+		if allowed > 0 {
+			return allowed, nil
+		}
+	}
+}
+
+// copyMessage copies source into destination, whose buffers have the same sizes as those of source, as in a batch of quic-go.
+func copyMessage(destination *ipv4.Message, source *ipv4.Message) {
+	var n int
+	for index := 0; index < len(destination.Buffers) && index < len(source.Buffers) && n < source.N; index++ {
+		size := min(len(source.Buffers[index]), source.N-n)
+		n += copy(destination.Buffers[index], source.Buffers[index][:size])
+	}
+	destination.N = n
+	destination.NN = copy(destination.OOB, source.OOB[:source.NN])
+	destination.Flags = source.Flags
+	destination.Addr = source.Addr
+}
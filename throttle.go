@@ -0,0 +1,186 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AuthBan is the authentication failure state of a source IPv4 address, or of the /64 prefix of a source IPv6 address,
+// since a single IPv6 client usually owns the whole prefix.
+type AuthBan struct {
+	Prefix   netip.Prefix
+	Failures int       // failures since the last ban
+	Bans     int       // number of bans, the ban window doubles each time
+	Until    time.Time // zero if not banned
+}
+
+type authThrottle struct {
+	threshold      int
+	banDuration    time.Duration
+	maxBanDuration time.Duration
+
+	access      sync.Mutex
+	entries     map[netip.Prefix]*authThrottleEntry
+	lastCleanup time.Time
+}
+
+const (
+	// authThrottleCleanupInterval limits how often recordFailure scans all entries.
+	authThrottleCleanupInterval = time.Minute
+	// authThrottleMaxEntries limits the memory used by sources with failures. When it is reached,
+	// an arbitrary source which is not banned is forgotten, or the failure is not recorded if all sources are banned.
+	authThrottleMaxEntries = 1 << 16
+)
+
+type authThrottleEntry struct {
+	failures    int
+	bans        int
+	bannedUntil time.Time
+	lastFailure time.Time
+}
+
+func newAuthThrottle(threshold int, banDuration time.Duration, maxBanDuration time.Duration) *authThrottle {
+	if banDuration == 0 {
+		banDuration = time.Minute
+	}
+	if maxBanDuration == 0 {
+		maxBanDuration = 24 * time.Hour
+	}
+	if maxBanDuration < banDuration {
+		maxBanDuration = banDuration
+	}
+	return &authThrottle{
+		threshold:      threshold,
+		banDuration:    banDuration,
+		maxBanDuration: maxBanDuration,
+		entries:        make(map[netip.Prefix]*authThrottleEntry),
+	}
+}
+
+// authThrottleKey returns the prefix tracking the failures of addr.
+func authThrottleKey(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, 32)
+	}
+	prefix, _ := addr.WithZone("").Prefix(64)
+	return prefix
+}
+
+func (t *authThrottle) banned(addr netip.Addr) bool {
+	t.access.Lock()
+	defer t.access.Unlock()
+	entry := t.entries[authThrottleKey(addr)]
+	return entry != nil && time.Now().Before(entry.bannedUntil)
+}
+
+func (t *authThrottle) recordFailure(addr netip.Addr) {
+	key := authThrottleKey(addr)
+	now := time.Now()
+	t.access.Lock()
+	defer t.access.Unlock()
+	if now.Sub(t.lastCleanup) >= authThrottleCleanupInterval {
+		t.cleanup(now)
+	}
+	entry := t.entries[key]
+	if entry == nil {
+		if len(t.entries) >= authThrottleMaxEntries && !t.evict(now) {
+			return
+		}
+		entry = &authThrottleEntry{}
+		t.entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	if entry.failures < t.threshold {
+		return
+	}
+	banDuration := t.banDuration << entry.bans
+	if banDuration > t.maxBanDuration || banDuration <= 0 {
+		banDuration = t.maxBanDuration
+	}
+	entry.failures = 0
+	entry.bans++
+	entry.bannedUntil = now.Add(banDuration)
+}
+
+func (t *authThrottle) recordSuccess(addr netip.Addr) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	delete(t.entries, authThrottleKey(addr))
+}
+
+// cleanup forgets sources which are not banned and have not failed for maxBanDuration.
+func (t *authThrottle) cleanup(now time.Time) {
+	t.lastCleanup = now
+	for key, entry := range t.entries {
+		if now.After(entry.bannedUntil) && now.Sub(entry.lastFailure) > t.maxBanDuration {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// evict forgets an arbitrary source which is not banned, and returns false if there is none.
+func (t *authThrottle) evict(now time.Time) bool {
+	for key, entry := range t.entries {
+		if !now.Before(entry.bannedUntil) {
+			delete(t.entries, key)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *authThrottle) list() []AuthBan {
+	now := time.Now()
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.cleanup(now)
+	bans := make([]AuthBan, 0, len(t.entries))
+	for key, entry := range t.entries {
+		ban := AuthBan{
+			Prefix:   key,
+			Failures: entry.failures,
+			Bans:     entry.bans,
+		}
+		if now.Before(entry.bannedUntil) {
+			ban.Until = entry.bannedUntil
+		}
+		bans = append(bans, ban)
+	}
+	slices.SortFunc(bans, func(a, b AuthBan) int {
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+	return bans
+}
+
+func (t *authThrottle) clear(addrs []netip.Addr) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if len(addrs) == 0 {
+		t.entries = make(map[netip.Prefix]*authThrottleEntry)
+		return
+	}
+	for _, addr := range addrs {
+		delete(t.entries, authThrottleKey(addr))
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAuthThrottleKey(t *testing.T) {
+	for _, testCase := range []struct {
+		addr string
+		key  string
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"::ffff:192.0.2.1", "192.0.2.1/32"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::1%eth0", "2001:db8:1:2::/64"},
+	} {
+		key := authThrottleKey(netip.MustParseAddr(testCase.addr))
+		if key.String() != testCase.key {
+			t.Errorf("authThrottleKey(%s) = %s, want %s", testCase.addr, key, testCase.key)
+		}
+	}
+}
+
+func TestAuthThrottleBan(t *testing.T) {
+	throttle := newAuthThrottle(2, time.Minute, 3*time.Minute)
+	addr := netip.MustParseAddr("2001:db8::1")
+	sameSubnet := netip.MustParseAddr("2001:db8::2")
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		throttle.recordFailure(addr)
+		if throttle.banned(addr) {
+			t.Fatal("banned before reaching the threshold")
+		}
+		startedAt := time.Now()
+		throttle.recordFailure(sameSubnet)
+		if !throttle.banned(addr) || !throttle.banned(sameSubnet) {
+			t.Fatal("not banned after reaching the threshold")
+		}
+		bans := throttle.list()
+		if len(bans) != 1 {
+			t.Fatalf("got %d entries, want 1", len(bans))
+		}
+		duration := bans[0].Until.Sub(startedAt)
+		if duration < want || duration > want+time.Second {
+			t.Fatalf("ban duration %s, want %s", duration, want)
+		}
+		throttle.entries[bans[0].Prefix].bannedUntil = time.Time{}
+	}
+	if throttle.banned(netip.MustParseAddr("2001:db8:0:1::1")) {
+		t.Fatal("banned a different /64")
+	}
+	throttle.recordSuccess(addr)
+	if len(throttle.list()) != 0 {
+		t.Fatal("success did not forget the source")
+	}
+}
+
+func TestAuthThrottleClear(t *testing.T) {
+	throttle := newAuthThrottle(1, 0, 0)
+	first := netip.MustParseAddr("192.0.2.1")
+	second := netip.MustParseAddr("192.0.2.2")
+	throttle.recordFailure(first)
+	throttle.recordFailure(second)
+	throttle.clear([]netip.Addr{netip.MustParseAddr("::ffff:192.0.2.1")})
+	if throttle.banned(first) || !throttle.banned(second) {
+		t.Fatal("clear did not forget only the given source")
+	}
+	throttle.clear(nil)
+	if throttle.banned(second) {
+		t.Fatal("clear did not forget all sources")
+	}
+}
+
+func TestAuthThrottleMaxEntries(t *testing.T) {
+	throttle := newAuthThrottle(2, 0, 0)
+	for index := range authThrottleMaxEntries {
+		throttle.recordFailure(netip.AddrFrom4([4]byte{10, byte(index >> 16), byte(index >> 8), byte(index)}))
+	}
+	throttle.recordFailure(netip.MustParseAddr("192.0.2.1"))
+	if len(throttle.entries) != authThrottleMaxEntries {
+		t.Fatalf("got %d entries, want %d", len(throttle.entries), authThrottleMaxEntries)
+	}
+	if throttle.entries[netip.MustParsePrefix("192.0.2.1/32")] == nil {
+		t.Fatal("new source not recorded when full")
+	}
+	// Banned sources are never evicted.
+	throttle = newAuthThrottle(1, 0, 0)
+	for index := range authThrottleMaxEntries {
+		throttle.recordFailure(netip.AddrFrom4([4]byte{10, byte(index >> 16), byte(index >> 8), byte(index)}))
+	}
+	throttle.recordFailure(netip.MustParseAddr("192.0.2.1"))
+	if throttle.banned(netip.MustParseAddr("192.0.2.1")) || !throttle.banned(netip.MustParseAddr("10.0.0.0")) {
+		t.Fatal("banned source evicted")
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+)
+
+// UserRecord is a user in a user file.
+//
+// A JSON user file is an array of records:
+//
+//	[{"name": "alice", "uuid": "...", "password": "...", "not_after": "2026-01-01T00:00:00Z"}]
+//
+// Additional passwords can be given with "passwords": [{"password": "...", "expires_at": "..."}].
+//
+// A CSV user file has a header row naming its columns, from name, uuid, password, password_expires_at, not_before and not_after.
+// Timestamps are in RFC 3339 format.
+type UserRecord struct {
+	Name      string       `json:"name"`
+	UUID      string       `json:"uuid"`
+	Password  string       `json:"password,omitempty"`
+	Passwords []Credential `json:"passwords,omitempty"`
+	NotBefore time.Time    `json:"not_before,omitzero"`
+	NotAfter  time.Time    `json:"not_after,omitzero"`
+}
+
+type UserFileOptions[U comparable] struct {
+	Context context.Context
+	Logger  logger.Logger
+	Path    string
+	// Format is "json" or "csv". If empty, it is detected from the file extension.
+	Format string
+	// Interval is the polling interval, default 10 seconds.
+	Interval time.Duration
+	// UserFunc converts a record to the user of the Service.
+	UserFunc func(record UserRecord) U
+}
+
+// UserFile loads users of a Service from a file, and reloads them when the file changes.
+// An invalid file is logged and ignored, and the previously loaded users are kept.
+type UserFile[U comparable] struct {
+	ctx      context.Context
+	logger   logger.Logger
+	service  *Service[U]
+	path     string
+	format   string
+	interval time.Duration
+	userFunc func(record UserRecord) U
+
+	access    sync.Mutex
+	modTime   time.Time
+	size      int64
+	checksum  [sha256.Size]byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewUserFile[U comparable](service *Service[U], options UserFileOptions[U]) (*UserFile[U], error) {
+	if options.UserFunc == nil {
+		return nil, exceptions.New("missing user function")
+	}
+	if options.Logger == nil {
+		options.Logger = logger.NOP()
+	}
+	if options.Interval == 0 {
+		options.Interval = 10 * time.Second
+	}
+	if options.Format == "" {
+		options.Format = strings.TrimPrefix(strings.ToLower(filepath.Ext(options.Path)), ".")
+	}
+	switch options.Format {
+	case "json", "csv":
+	default:
+		return nil, exceptions.New("unknown user file format: ", options.Format)
+	}
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &UserFile[U]{
+		ctx:      ctx,
+		logger:   options.Logger,
+		service:  service,
+		path:     options.Path,
+		format:   options.Format,
+		interval: options.Interval,
+		userFunc: options.UserFunc,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start loads the file, and then polls it for changes until Close is called or the context is done.
+func (f *UserFile[U]) Start() error {
+	err := f.Reload()
+	if err != nil {
+		return err
+	}
+	go f.loopReload()
+	return nil
+}
+
+func (f *UserFile[U]) loopReload() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+		err := f.reloadIfChanged()
+		if err != nil {
+			f.logger.Error(exceptions.Cause(err, "reload user file ", f.path))
+		}
+	}
+}
+
+func (f *UserFile[U]) reloadIfChanged() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.access.Lock()
+	changed := !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+	f.access.Unlock()
+	if !changed {
+		return nil
+	}
+	return f.Reload()
+}
+
+// Reload loads the file immediately. Users are not updated if the content is unchanged.
+func (f *UserFile[U]) Reload() error {
+	f.access.Lock()
+	defer f.access.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	checksum := sha256.Sum256(content)
+	if checksum == f.checksum {
+		return nil
+	}
+	records, err := parseUserRecords(bytes.NewReader(content), f.format)
+	if err != nil {
+		return err
+	}
+	userList := make([]User[U], 0, len(records))
+	for index, record := range records {
+		userUUID, err := parseUUID(record.UUID)
+		if err != nil {
+			return exceptions.Cause(err, "record ", index)
+		}
+		var credentials []Credential
+		if record.Password != "" {
+			credentials = append(credentials, Credential{Password: record.Password})
+		}
+		credentials = append(credentials, record.Passwords...)
+		if len(credentials) == 0 {
+			return exceptions.New("record ", index, ": missing password")
+		}
+		userList = append(userList, User[U]{
+			User:        f.userFunc(record),
+			UUID:        userUUID,
+			Credentials: credentials,
+			Validity: UserValidity{
+				NotBefore: record.NotBefore,
+				NotAfter:  record.NotAfter,
+			},
+		})
+	}
+	err = f.service.ReplaceUsers(userList)
+	if err != nil {
+		return err
+	}
+	f.checksum = checksum
+	f.logger.Info("loaded ", len(userList), " users from ", f.path)
+	return nil
+}
+
+func (f *UserFile[U]) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+	return nil
+}
+
+func parseUserRecords(reader io.Reader, format string) ([]UserRecord, error) {
+	switch format {
+	case "json":
+		var records []UserRecord
+		err := json.NewDecoder(reader).Decode(&records)
+		if err != nil {
+			return nil, exceptions.Cause(err, "decode json")
+		}
+		return records, nil
+	case "csv":
+		return parseCSVUserRecords(reader)
+	default:
+		return nil, exceptions.New("unknown user file format: ", format)
+	}
+}
+
+func parseCSVUserRecords(reader io.Reader) ([]UserRecord, error) {
+	rows, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, exceptions.Cause(err, "decode csv")
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	header := rows[0]
+	for _, column := range header {
+		switch column {
+		case "name", "uuid", "password", "password_expires_at", "not_before", "not_after":
+		default:
+			return nil, exceptions.New("unknown csv column: ", column)
+		}
+	}
+	records := make([]UserRecord, 0, len(rows)-1)
+	for rowIndex, row := range rows[1:] {
+		var (
+			record            UserRecord
+			passwordExpiresAt time.Time
+		)
+		for index, value := range row {
+			var timeValue *time.Time
+			switch header[index] {
+			case "name":
+				record.Name = value
+			case "uuid":
+				record.UUID = value
+			case "password":
+				record.Password = value
+			case "password_expires_at":
+				timeValue = &passwordExpiresAt
+			case "not_before":
+				timeValue = &record.NotBefore
+			case "not_after":
+				timeValue = &record.NotAfter
+			}
+			if timeValue != nil && value != "" {
+				*timeValue, err = time.Parse(time.RFC3339, value)
+				if err != nil {
+					return nil, exceptions.Cause(err, "row ", rowIndex+2, ": parse ", header[index])
+				}
+			}
+		}
+		if !passwordExpiresAt.IsZero() {
+			record.Passwords = []Credential{{Password: record.Password, ExpiresAt: passwordExpiresAt}}
+			record.Password = ""
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func parseUUID(value string) ([16]byte, error) {
+	var userUUID [16]byte
+	hexValue := strings.ReplaceAll(value, "-", "")
+	if len(hexValue) != 32 || (len(value) != 32 && (len(value) != 36 || value[8] != '-' || value[13] != '-' || value[18] != '-' || value[23] != '-')) {
+		return userUUID, exceptions.New("invalid uuid: ", value)
+	}
+	_, err := hex.Decode(userUUID[:], []byte(hexValue))
+	if err != nil {
+		return userUUID, exceptions.New("invalid uuid: ", value)
+	}
+	return userUUID, nil
+}
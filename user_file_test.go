@@ -0,0 +1,194 @@
+/*
+Copyright (C) 2025  dyhkwong
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package juicity
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUUID(t *testing.T) {
+	want := [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	for _, testCase := range []struct {
+		value string
+		valid bool
+	}{
+		{"01234567-89ab-cdef-0123-456789abcdef", true},
+		{"01234567-89AB-CDEF-0123-456789ABCDEF", true},
+		{"0123456789abcdef0123456789abcdef", true},
+		{"", false},
+		{"01234567-89ab-cdef-0123-456789abcde", false},
+		{"0123456789ab-cdef-0123-456789abcdef", false},
+		{"01234567-89abc-def-0123-456789abcdef", false},
+		{"0123-4567-89ab-cdef-0123456789abcdef", false},
+		{"01234567-89ab-cdef-0123-456789abcdeg", false},
+		{"01234567-89ab-cdef-0123-456789abcdef0", false},
+	} {
+		userUUID, err := parseUUID(testCase.value)
+		if (err == nil) != testCase.valid {
+			t.Errorf("parseUUID(%q) error = %v, want valid %v", testCase.value, err, testCase.valid)
+			continue
+		}
+		if testCase.valid && userUUID != want {
+			t.Errorf("parseUUID(%q) = %x", testCase.value, userUUID)
+		}
+	}
+}
+
+func TestParseCSVUserRecords(t *testing.T) {
+	expiresAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, testCase := range []struct {
+		name    string
+		content string
+		records []UserRecord
+		valid   bool
+	}{
+		{
+			name:  "empty",
+			valid: true,
+		},
+		{
+			name:    "header only",
+			content: "name,uuid,password\n",
+			records: []UserRecord{},
+			valid:   true,
+		},
+		{
+			name:    "reordered columns",
+			content: "password,uuid,name,not_after\npw,0123456789abcdef0123456789abcdef,alice,2027-01-01T00:00:00Z\n",
+			records: []UserRecord{{Name: "alice", UUID: "0123456789abcdef0123456789abcdef", Password: "pw", NotAfter: notAfter}},
+			valid:   true,
+		},
+		{
+			name:    "password expiry",
+			content: "uuid,password,password_expires_at,not_before\nu,pw,2026-01-01T00:00:00Z,\n",
+			records: []UserRecord{{UUID: "u", Passwords: []Credential{{Password: "pw", ExpiresAt: expiresAt}}}},
+			valid:   true,
+		},
+		{
+			name:    "unknown column",
+			content: "uuid,password,group\nu,pw,g\n",
+		},
+		{
+			name:    "invalid time",
+			content: "uuid,password,not_after\nu,pw,tomorrow\n",
+		},
+		{
+			name:    "wrong number of fields",
+			content: "uuid,password\nu\n",
+		},
+	} {
+		records, err := parseCSVUserRecords(strings.NewReader(testCase.content))
+		if (err == nil) != testCase.valid {
+			t.Errorf("%s: error = %v, want valid %v", testCase.name, err, testCase.valid)
+			continue
+		}
+		if testCase.valid && !reflect.DeepEqual(records, testCase.records) {
+			t.Errorf("%s: records = %+v, want %+v", testCase.name, records, testCase.records)
+		}
+	}
+}
+
+func TestParseJSONUserRecords(t *testing.T) {
+	records, err := parseUserRecords(strings.NewReader(`[{"name": "alice", "uuid": "u", "passwords": [{"password": "pw", "expires_at": "2026-01-01T00:00:00Z"}]}]`), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UserRecord{{Name: "alice", UUID: "u", Passwords: []Credential{{Password: "pw", ExpiresAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}}}}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("records = %+v, want %+v", records, want)
+	}
+	_, err = parseUserRecords(strings.NewReader(`{}`), "json")
+	if err == nil {
+		t.Fatal("decoded an object as records")
+	}
+	_, err = parseUserRecords(strings.NewReader(``), "yaml")
+	if err == nil {
+		t.Fatal("parsed an unknown format")
+	}
+}
+
+func TestReplaceUsersDuplicate(t *testing.T) {
+	service, err := NewService[string](ServiceOptions{Context: context.Background()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := []Credential{{Password: "pw"}}
+	for _, testCase := range []struct {
+		name  string
+		users []User[string]
+		valid bool
+	}{
+		{"distinct", []User[string]{{User: "alice", UUID: [16]byte{1}, Credentials: credentials}, {User: "bob", UUID: [16]byte{2}, Credentials: credentials}}, true},
+		{"duplicate uuid", []User[string]{{User: "alice", UUID: [16]byte{1}, Credentials: credentials}, {User: "bob", UUID: [16]byte{1}, Credentials: credentials}}, false},
+		{"duplicate user", []User[string]{{User: "alice", UUID: [16]byte{1}, Credentials: credentials}, {User: "alice", UUID: [16]byte{2}, Credentials: credentials}}, false},
+	} {
+		err = service.ReplaceUsers(testCase.users)
+		if (err == nil) != testCase.valid {
+			t.Errorf("%s: error = %v, want valid %v", testCase.name, err, testCase.valid)
+		}
+	}
+	// A rejected update keeps the previous users.
+	if len(service.users.Load().userMap) != 2 {
+		t.Fatal("rejected update replaced users")
+	}
+}
+
+func TestUserFileReload(t *testing.T) {
+	service, err := NewService[string](ServiceOptions{Context: context.Background()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.csv")
+	err = os.WriteFile(path, []byte("name,uuid,password\nalice,01234567-89ab-cdef-0123-456789abcdef,pw\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userFile, err := NewUserFile(service, UserFileOptions[string]{
+		Path: path,
+		UserFunc: func(record UserRecord) string {
+			return record.Name
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = userFile.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.users.Load().credentialMap["alice"][0].Password != "pw" {
+		t.Fatal("users not loaded")
+	}
+	err = os.WriteFile(path, []byte("name,uuid\nbob,invalid\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userFile.Reload() == nil {
+		t.Fatal("loaded an invalid file")
+	}
+	if _, loaded := service.users.Load().credentialMap["alice"]; !loaded {
+		t.Fatal("invalid file replaced users")
+	}
+}